@@ -0,0 +1,203 @@
+package cbpatch
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Action is what a patch does to the compiled list, Patch.GetAction returns one of these as a string
+type Action string
+
+const (
+	// ActionAdd sets the key to the patch's values
+	ActionAdd Action = "+"
+	// ActionRemove removes the key
+	ActionRemove Action = "-"
+	// ActionClear removes every key
+	ActionClear Action = "*"
+	// ActionAppend appends the patch's values to those of the key, adding the key if it is missing
+	ActionAppend Action = "+="
+	// ActionRemoveValues removes every occurrence of the patch's values from those of the key
+	ActionRemoveValues Action = "-="
+	// ActionSetField sets one value of the key, the patch's values are the index followed by the new value.
+	// Missing values before the index are left empty.
+	ActionSetField Action = "="
+	// ActionClearPrefix removes every key starting with the patch's key
+	ActionClearPrefix Action = "^"
+	// ActionClearCategory removes every key whose category is the patch's key, see Master.KeyCategory
+	ActionClearCategory Action = "#"
+)
+
+// KeyCategorySeparator ends the category at the start of a key, see DefaultKeyCategory
+const KeyCategorySeparator = ":"
+
+// DefaultKeyCategory returns the part of the key before the first KeyCategorySeparator, or an empty category for
+// keys without one
+func DefaultKeyCategory(key string) string {
+	index := strings.Index(key, KeyCategorySeparator)
+	if index < 0 {
+		return ""
+	}
+
+	return key[:index]
+}
+
+// Valid reports whether the action is one of the known actions
+func (a Action) Valid() bool {
+	switch a {
+	case ActionAdd, ActionRemove, ActionClear, ActionAppend, ActionRemoveValues, ActionSetField, ActionClearPrefix,
+		ActionClearCategory:
+		return true
+	}
+
+	return false
+}
+
+// ParseAction returns the Action for a patch action, or an InvalidPatchError if it is not one
+func ParseAction(action string) (Action, error) {
+	if !Action(action).Valid() {
+		return "", &InvalidPatchError{Action: action, Reason: "unknown action"}
+	}
+
+	return Action(action), nil
+}
+
+// validatePatch checks the patch's action is known and its key and values suit it
+func validatePatch(patch Patch) error {
+	invalid := func(reason string) error {
+		return &InvalidPatchError{Key: patch.GetKey(), Action: patch.GetAction(), Reason: reason}
+	}
+
+	action := Action(patch.GetAction())
+	if !action.Valid() {
+		return invalid("unknown action")
+	}
+	if patch.GetKey() == "" && action == ActionClearPrefix {
+		return invalid("clear prefix requires a prefix, use clear to remove every key")
+	}
+	if !patchExpires(patch).IsZero() && action != ActionAdd {
+		return invalid("only add patches can expire")
+	}
+	if action == ActionSetField {
+		if len(patch.GetValues()) != 2 {
+			return invalid("set field requires an index and a value")
+		}
+		index, e := strconv.Atoi(patch.GetValues()[0])
+		if e != nil || index < 0 {
+			return invalid("set field index must be a non-negative integer")
+		}
+	}
+
+	return nil
+}
+
+// listState is a compiled list along with when each of its expiring keys expires, and how many clear patches
+// have been applied to it
+type listState struct {
+	Values  map[string][]string
+	Expires map[string]time.Time
+	Clears  int
+}
+
+func newListState() *listState {
+	return &listState{
+		Values:  make(map[string][]string),
+		Expires: make(map[string]time.Time),
+	}
+}
+
+// apply applies the patch to the list. Values are never modified in place as they may be shared with patches and
+// earlier lists. Unknown actions are ignored.
+func (l *listState) apply(patch Patch, keyCategory func(key string) string) {
+	key := patch.GetKey()
+	switch Action(patch.GetAction()) {
+	case ActionAdd:
+		l.Values[key] = patch.GetValues()
+		expires := patchExpires(patch)
+		if expires.IsZero() {
+			delete(l.Expires, key)
+		} else {
+			l.Expires[key] = expires
+		}
+	case ActionRemove:
+		l.remove(key)
+	case ActionClear:
+		l.Values = make(map[string][]string)
+		l.Expires = make(map[string]time.Time)
+		l.Clears++
+	case ActionAppend:
+		values := make([]string, 0, len(l.Values[key])+len(patch.GetValues()))
+		values = append(values, l.Values[key]...)
+		l.Values[key] = append(values, patch.GetValues()...)
+	case ActionRemoveValues:
+		existing, ok := l.Values[key]
+		if !ok {
+			break
+		}
+		values := make([]string, 0, len(existing))
+		for _, value := range existing {
+			if !containsValue(patch.GetValues(), value) {
+				values = append(values, value)
+			}
+		}
+		l.Values[key] = values
+	case ActionSetField:
+		if len(patch.GetValues()) != 2 {
+			break
+		}
+		index, e := strconv.Atoi(patch.GetValues()[0])
+		if e != nil || index < 0 {
+			break
+		}
+		length := len(l.Values[key])
+		if index >= length {
+			length = index + 1
+		}
+		values := make([]string, length)
+		copy(values, l.Values[key])
+		values[index] = patch.GetValues()[1]
+		l.Values[key] = values
+	case ActionClearPrefix:
+		for existing := range l.Values {
+			if strings.HasPrefix(existing, key) {
+				l.remove(existing)
+			}
+		}
+	case ActionClearCategory:
+		for existing := range l.Values {
+			if keyCategory(existing) == key {
+				l.remove(existing)
+			}
+		}
+	}
+}
+
+func (l *listState) remove(key string) {
+	delete(l.Values, key)
+	delete(l.Expires, key)
+}
+
+// listAsOf returns a copy of the list without the keys which have expired by the given time
+func (l *listState) listAsOf(now time.Time) map[string][]string {
+	list := make(map[string][]string, len(l.Values))
+	for key, values := range l.Values {
+		expires, ok := l.Expires[key]
+		if ok && !expires.After(now) {
+			continue
+		}
+		list[key] = values
+	}
+
+	return list
+}
+
+func containsValue(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,8 +1,8 @@
 package cbpatch
 
 import (
-	"cloud.google.com/go/storage"
 	"compress/zlib"
+	"context"
 	"crypto/md5"
 	"encoding/csv"
 	"errors"
@@ -30,6 +30,9 @@ type Bucket struct {
 	PatchCount        int
 	Validation        func(line []string, bucket *Bucket) error
 	Patches           []Patch
+	StreamPatches     bool
+	PublicUrlResolver PublicUrlResolver
+	HttpDownloader    *HttpDownloader
 	ErrorHandler      ErrorHandler
 	Logger            Logger
 	Storage           Storage
@@ -87,36 +90,90 @@ func (b *Bucket) Init() error {
 }
 
 func (b *Bucket) Download() error {
-	b.Logger.DebugF("debug", "downloading bucket from: %s", b.RemoteFilePath)
-	e := b.ZippedFile.Truncate(0)
+	return b.DownloadContext(context.Background())
+}
+
+func (b *Bucket) DownloadContext(ctx context.Context) error {
+	var e error
+	if b.HttpDownloader != nil {
+		e = b.downloadHttp(ctx)
+		if e != nil {
+			b.ErrorHandler.Error(e)
+			return e
+		}
+	} else {
+		b.Logger.DebugF("debug", "downloading bucket from: %s", b.RemoteFilePath)
+		e = b.ZippedFile.Truncate(0)
+		if e != nil {
+			b.ErrorHandler.Error(e)
+			return e
+		}
+		_, e = b.ZippedFile.Seek(0, io.SeekStart)
+		if e != nil {
+			b.ErrorHandler.Error(e)
+			return e
+		}
+		e = b.Storage.DownloadWriter(ctx, b.StorageBucketName, b.RemoteFilePath, b.ZippedFile)
+		if e != nil && (!errors.Is(e, ErrObjectNotExist) || b.ZippedHash != "") {
+			e = missingObject(e, b.RemoteFilePath)
+			b.ErrorHandler.Error(e)
+			return e
+		}
+	}
+
+	e = b.Unzip()
 	if e != nil {
 		b.ErrorHandler.Error(e)
 		return e
 	}
-	_, e = b.ZippedFile.Seek(0, io.SeekStart)
+
+	e = b.VerifyUnzipped()
 	if e != nil {
 		b.ErrorHandler.Error(e)
 		return e
 	}
-	e = b.Storage.DownloadWriter(b.StorageBucketName, b.RemoteFilePath, b.ZippedFile)
-	if e != nil && !errors.Is(e, storage.ErrObjectNotExist) {
-		b.ErrorHandler.Error(e)
+
+	return nil
+}
+
+// downloadHttp fetches the zipped bucket from its public URL, keeping the local zipped file when the server
+// reports it is unchanged and it still matches the master checksum
+func (b *Bucket) downloadHttp(ctx context.Context) error {
+	publicUrl := b.PublicUrl()
+	b.Logger.DebugF("debug", "downloading bucket over http from: %s", publicUrl)
+
+	info, e := b.ZippedFile.Stat()
+	if e != nil {
 		return e
 	}
 
-	e = b.Unzip()
-	if e != nil {
-		b.ErrorHandler.Error(e)
+	body, modified, e := b.HttpDownloader.Download(ctx, publicUrl, info.Size() > 0)
+	if e == nil && !modified {
+		var checksum string
+		checksum, e = checksumReadSeeker(b.ZippedFile)
+		if e != nil {
+			return e
+		}
+		if checksum == b.ZippedHash {
+			b.Logger.DebugF("debug", "bucket not modified: %s", publicUrl)
+			return nil
+		}
+		body, _, e = b.HttpDownloader.Download(ctx, publicUrl, false)
+	}
+	if e != nil && (!errors.Is(e, ErrObjectNotExist) || b.ZippedHash != "") {
 		return e
 	}
 
-	e = b.VerifyUnzipped()
+	e = b.ZippedFile.Truncate(0)
 	if e != nil {
-		b.ErrorHandler.Error(e)
 		return e
 	}
-
-	return nil
+	_, e = b.ZippedFile.Seek(0, io.SeekStart)
+	if e != nil {
+		return e
+	}
+	_, e = b.ZippedFile.Write(body)
+	return e
 }
 
 func (b *Bucket) Unzip() error {
@@ -126,8 +183,12 @@ func (b *Bucket) Unzip() error {
 		return e
 	}
 	if b.ZippedHash != checksum {
-		e := fmt.Errorf("invalid zipped checksum for %s", b.RemoteFilePath)
-		return e
+		return &ChecksumMismatchError{
+			Path:     b.RemoteFilePath,
+			Zipped:   true,
+			Expected: b.ZippedHash,
+			Actual:   checksum,
+		}
 	}
 	b.Logger.DebugF("debug", "zipped file matched master.csv checksum: %s", b.ZippedHash)
 
@@ -165,8 +226,11 @@ func (b *Bucket) VerifyUnzipped() error {
 		return e
 	}
 	if b.UnzippedHash != checksum {
-		e := fmt.Errorf("invalid unzipped checksum for %s", b.RemoteFilePath)
-		return e
+		return &ChecksumMismatchError{
+			Path:     b.RemoteFilePath,
+			Expected: b.UnzippedHash,
+			Actual:   checksum,
+		}
 	}
 	b.Logger.DebugF("debug", "unzipped file matched master.csv checksum: %s", b.UnzippedHash)
 
@@ -177,38 +241,48 @@ func (b *Bucket) VerifyUnzipped() error {
 	}
 
 	b.Logger.DebugF("debug", "verifying bucket")
+	b.Patches = nil
+	b.PatchCount = 0
 	verifyBucketReader := csv.NewReader(b.File)
+	verifyBucketReader.FieldsPerRecord = -1
+	lineNumber := 0
 	for true {
 		line, e := verifyBucketReader.Read()
 
 		if e == io.EOF {
 			break
 		}
+		lineNumber++
+		if e != nil {
+			return &MalformedRowError{
+				Path:   b.RemoteFilePath,
+				Line:   lineNumber,
+				Reason: "unreadable csv",
+				Err:    e,
+			}
+		}
 
-		validationE := b.Validation(line, b)
+		validationE := b.Validation(validationLine(line), b)
 		if validationE != nil {
-			return validationE
+			return &ValidationError{
+				Path: b.RemoteFilePath,
+				Line: lineNumber,
+				Err:  validationE,
+			}
 		}
 
 		if len(line) < 2 {
-			e := fmt.Errorf("bucket contained a row with less than 2 elements: %s", b.RemoteFilePath)
-			return e
+			return &MalformedRowError{
+				Path:   b.RemoteFilePath,
+				Line:   lineNumber,
+				Reason: "bucket contained a row with less than 2 elements",
+			}
 		}
 
-		if len(line) == 2 {
-			b.Patches = append(b.Patches, &DefaultPatch{
-				Action: line[0],
-				Key:    line[1],
-				Values: []string{},
-			})
-		} else {
-			b.Patches = append(b.Patches, &DefaultPatch{
-				Action: line[0],
-				Key:    line[1],
-				Values: line[2:],
-			})
+		b.PatchCount++
+		if !b.StreamPatches {
+			b.Patches = append(b.Patches, patchFromLine(line))
 		}
-
 	}
 
 	_, e = b.File.Seek(0, io.SeekStart)
@@ -220,7 +294,13 @@ func (b *Bucket) VerifyUnzipped() error {
 }
 
 func (b *Bucket) AddPatch(patch Patch) error {
-	_, e := b.File.Seek(0, io.SeekEnd)
+	e := validatePatch(patch)
+	if e != nil {
+		b.ErrorHandler.Error(e)
+		return e
+	}
+
+	_, e = b.File.Seek(0, io.SeekEnd)
 	if e != nil {
 		b.ErrorHandler.Error(e)
 		return e
@@ -228,10 +308,7 @@ func (b *Bucket) AddPatch(patch Patch) error {
 
 	patchWriter := csv.NewWriter(b.File)
 
-	e = patchWriter.Write(append([]string{
-		patch.GetAction(),
-		patch.GetKey(),
-	}, patch.GetValues()...))
+	e = patchWriter.Write(patchRow(patch))
 	if e != nil {
 		b.ErrorHandler.Error(e)
 		return e
@@ -242,7 +319,59 @@ func (b *Bucket) AddPatch(patch Patch) error {
 	}
 
 	b.IsChanged = true
-	b.Patches = append(b.Patches, patch)
+	b.PatchCount++
+	if !b.StreamPatches {
+		b.Patches = append(b.Patches, patch)
+	}
+	return nil
+}
+
+// Replay calls fn with each patch of the bucket from the given index onwards. Streaming buckets read them from
+// the unzipped file, so only the patch being replayed is held in memory.
+func (b *Bucket) Replay(from int, fn func(index int, patch Patch) error) error {
+	if !b.StreamPatches {
+		for index := from; index < len(b.Patches); index++ {
+			e := fn(index, b.Patches[index])
+			if e != nil {
+				return e
+			}
+		}
+
+		return nil
+	}
+
+	info, e := b.File.Stat()
+	if e != nil {
+		b.ErrorHandler.Error(e)
+		return e
+	}
+	// read through a section so the file offset used by AddPatch is left alone
+	patchReader := csv.NewReader(io.NewSectionReader(b.File, 0, info.Size()))
+	patchReader.FieldsPerRecord = -1
+	patchReader.ReuseRecord = true
+	for index := 0; true; index++ {
+		line, e := patchReader.Read()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return &MalformedRowError{
+				Path:   b.RemoteFilePath,
+				Line:   index + 1,
+				Reason: "unreadable csv",
+				Err:    e,
+			}
+		}
+		if index < from {
+			continue
+		}
+
+		e = fn(index, patchFromLine(line))
+		if e != nil {
+			return e
+		}
+	}
+
 	return nil
 }
 
@@ -302,16 +431,31 @@ func (b *Bucket) VerifyZipped() error {
 	}
 	b.Logger.DebugF("debug", "verifying zipped bucket")
 	verifyBucketReader := csv.NewReader(bucketZipReader)
+	verifyBucketReader.FieldsPerRecord = -1
+	lineNumber := 0
 	for true {
 		line, e := verifyBucketReader.Read()
 
 		if e == io.EOF {
 			break
 		}
+		lineNumber++
+		if e != nil {
+			return &MalformedRowError{
+				Path:   b.ZippedFileName,
+				Line:   lineNumber,
+				Reason: "unreadable csv",
+				Err:    e,
+			}
+		}
 
-		validationE := b.Validation(line, b)
+		validationE := b.Validation(validationLine(line), b)
 		if validationE != nil {
-			return validationE
+			return &ValidationError{
+				Path: b.ZippedFileName,
+				Line: lineNumber,
+				Err:  validationE,
+			}
 		}
 	}
 
@@ -335,6 +479,10 @@ func (b *Bucket) Hash() error {
 }
 
 func (b *Bucket) Upload(public bool) error {
+	return b.UploadContext(context.Background(), public)
+}
+
+func (b *Bucket) UploadContext(ctx context.Context, public bool) error {
 	_, e := b.ZippedFile.Seek(0, io.SeekStart)
 	if e != nil {
 		b.ErrorHandler.Error(e)
@@ -344,6 +492,7 @@ func (b *Bucket) Upload(public bool) error {
 	b.Logger.DebugF("debug", "Uploading to: %s", b.RemoteFilePath)
 
 	storageWriter, e := b.Storage.GetUploadWriter(
+		ctx,
 		b.StorageBucketName,
 		b.RemoteFilePath,
 	)
@@ -352,7 +501,7 @@ func (b *Bucket) Upload(public bool) error {
 		return e
 	}
 
-	_, e = io.Copy(storageWriter, b.ZippedFile)
+	_, e = copyContext(ctx, storageWriter, b.ZippedFile)
 	if e != nil {
 		b.ErrorHandler.Error(e)
 		return e
@@ -365,6 +514,7 @@ func (b *Bucket) Upload(public bool) error {
 
 	if public {
 		e = b.Storage.MakePublic(
+			ctx,
 			b.StorageBucketName,
 			b.RemoteFilePath,
 		)
@@ -377,6 +527,25 @@ func (b *Bucket) Upload(public bool) error {
 	return nil
 }
 
+// PublicUrl returns the URL the zipped bucket can be fetched from once it has been uploaded publicly
+func (b *Bucket) PublicUrl() string {
+	if b.PublicUrlResolver == nil {
+		return ""
+	}
+
+	return b.PublicUrlResolver(b.StorageBucketName, b.RemoteFilePath)
+}
+
+// missingObject adds the path to ErrObjectNotExist errors, which backends return without it, so callers can tell
+// a missing object apart from one which must be downloaded again
+func missingObject(e error, path string) error {
+	if !errors.Is(e, ErrObjectNotExist) {
+		return e
+	}
+
+	return fmt.Errorf("%w: %s", e, path)
+}
+
 func checksumReadSeeker(seeker io.ReadSeeker) (string, error) {
 	_, e := seeker.Seek(0, io.SeekStart)
 	if e != nil {
@@ -0,0 +1,73 @@
+package cbpatch
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBucket_DownloadContext_NotModifiedThenError(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requests++
+		if requests == 1 {
+			writer.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writer.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	bucket := NewBucket(
+		testErrorHandler{},
+		testLogger{},
+		nil,
+		"bucket",
+		"1.csv.zlib",
+		"lists/1.csv.zlib",
+		dir,
+		1,
+		"expected",
+		"expected",
+		0,
+		nil,
+	)
+	bucket.PublicUrlResolver = NewPublicUrlTemplate(server.URL + "/{name}")
+	bucket.HttpDownloader = NewHttpDownloader(server.Client(), 0, 0, testLogger{})
+	e := bucket.Init()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer bucket.ZippedFile.Close()
+	defer bucket.File.Close()
+	_, e = bucket.ZippedFile.Write([]byte("stale"))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// the local file no longer matches, so the bucket is fetched again and that fails
+	e = bucket.DownloadContext(context.Background())
+	var statusError *HttpStatusError
+	if !errors.As(e, &statusError) || statusError.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a 403 HttpStatusError, got %v", e)
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+
+	zipped, e := ioutil.ReadFile(filepath.Join(dir, bucket.ZippedFileName))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if string(zipped) != "stale" {
+		t.Errorf("expected the local file to be left alone, got %q", zipped)
+	}
+}
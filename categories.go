@@ -1,11 +1,10 @@
 package cbpatch
 
 import (
-	"cloud.google.com/go/storage"
 	"compress/zlib"
+	"context"
 	"encoding/csv"
 	"errors"
-	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -24,6 +23,8 @@ type Categories struct {
 	ZippedHash        string
 	UnzippedHash      string
 	CategoryItems     []CategoriesItem
+	PublicUrlResolver PublicUrlResolver
+	HttpDownloader    *HttpDownloader
 	ErrorHandler      ErrorHandler
 	Logger            Logger
 	Storage           Storage
@@ -77,9 +78,24 @@ func (c *Categories) Init() error {
 }
 
 func (c *Categories) Download() error {
-	c.Logger.DebugF("debug", "downloading categories from: %s", c.RemoteFilePath)
-	e := c.Storage.DownloadWriter(c.StorageBucketName, c.RemoteFilePath, c.ZippedFile)
-	if e != nil && !errors.Is(e, storage.ErrObjectNotExist) {
+	return c.DownloadContext(context.Background())
+}
+
+func (c *Categories) DownloadContext(ctx context.Context) error {
+	var e error
+	if c.HttpDownloader != nil {
+		c.Logger.DebugF("debug", "downloading categories over http from: %s", c.PublicUrl())
+		var body []byte
+		body, _, e = c.HttpDownloader.Download(ctx, c.PublicUrl(), false)
+		if e == nil {
+			_, e = c.ZippedFile.Write(body)
+		}
+	} else {
+		c.Logger.DebugF("debug", "downloading categories from: %s", c.RemoteFilePath)
+		e = c.Storage.DownloadWriter(ctx, c.StorageBucketName, c.RemoteFilePath, c.ZippedFile)
+	}
+	if e != nil && (!errors.Is(e, ErrObjectNotExist) || c.ZippedHash != "") {
+		e = missingObject(e, c.RemoteFilePath)
 		c.ErrorHandler.Error(e)
 		return e
 	}
@@ -90,7 +106,12 @@ func (c *Categories) Download() error {
 		return e
 	}
 	if c.ZippedHash != checksum {
-		e := fmt.Errorf("invalid zipped checksum for %s", c.RemoteFilePath)
+		e := &ChecksumMismatchError{
+			Path:     c.RemoteFilePath,
+			Zipped:   true,
+			Expected: c.ZippedHash,
+			Actual:   checksum,
+		}
 		c.ErrorHandler.Error(e)
 		return e
 	}
@@ -118,7 +139,11 @@ func (c *Categories) Download() error {
 		return e
 	}
 	if c.UnzippedHash != checksum {
-		e := fmt.Errorf("invalid unzipped checksum for %s", c.RemoteFilePath)
+		e := &ChecksumMismatchError{
+			Path:     c.RemoteFilePath,
+			Expected: c.UnzippedHash,
+			Actual:   checksum,
+		}
 		c.ErrorHandler.Error(e)
 		return e
 	}
@@ -133,15 +158,32 @@ func (c *Categories) Download() error {
 
 	c.Logger.DebugF("debug", "verifying categories")
 	verifyBucketReader := csv.NewReader(c.File)
+	verifyBucketReader.FieldsPerRecord = -1
+	lineNumber := 0
 	for true {
 		line, e := verifyBucketReader.Read()
 
 		if e == io.EOF {
 			break
 		}
+		lineNumber++
+		if e != nil {
+			e := &MalformedRowError{
+				Path:   c.RemoteFilePath,
+				Line:   lineNumber,
+				Reason: "unreadable csv",
+				Err:    e,
+			}
+			c.ErrorHandler.Error(e)
+			return e
+		}
 
 		if len(line) != 4 {
-			e := fmt.Errorf("categories contained a row which was not 4 columns: %s", c.RemoteFilePath)
+			e := &MalformedRowError{
+				Path:   c.RemoteFilePath,
+				Line:   lineNumber,
+				Reason: "categories contained a row which was not 4 columns",
+			}
 			c.ErrorHandler.Error(e)
 			return e
 		}
@@ -249,6 +291,10 @@ func (c *Categories) Hash() error {
 }
 
 func (c *Categories) Upload(public bool) error {
+	return c.UploadContext(context.Background(), public)
+}
+
+func (c *Categories) UploadContext(ctx context.Context, public bool) error {
 	_, e := c.ZippedFile.Seek(0, io.SeekStart)
 	if e != nil {
 		c.ErrorHandler.Error(e)
@@ -258,6 +304,7 @@ func (c *Categories) Upload(public bool) error {
 	c.Logger.DebugF("debug", "Uploading to: %s", c.RemoteFilePath)
 
 	storageWriter, e := c.Storage.GetUploadWriter(
+		ctx,
 		c.StorageBucketName,
 		c.RemoteFilePath,
 	)
@@ -266,7 +313,7 @@ func (c *Categories) Upload(public bool) error {
 		return e
 	}
 
-	_, e = io.Copy(storageWriter, c.ZippedFile)
+	_, e = copyContext(ctx, storageWriter, c.ZippedFile)
 	if e != nil {
 		c.ErrorHandler.Error(e)
 		return e
@@ -279,6 +326,7 @@ func (c *Categories) Upload(public bool) error {
 
 	if public {
 		e = c.Storage.MakePublic(
+			ctx,
 			c.StorageBucketName,
 			c.RemoteFilePath,
 		)
@@ -290,3 +338,12 @@ func (c *Categories) Upload(public bool) error {
 
 	return nil
 }
+
+// PublicUrl returns the URL the zipped categories can be fetched from once they have been uploaded publicly
+func (c *Categories) PublicUrl() string {
+	if c.PublicUrlResolver == nil {
+		return ""
+	}
+
+	return c.PublicUrlResolver(c.StorageBucketName, c.RemoteFilePath)
+}
@@ -0,0 +1,193 @@
+package cbpatch
+
+import (
+	"context"
+	"sort"
+)
+
+func (m *Master) Compact() error {
+	return m.CompactContext(context.Background())
+}
+
+// CompactContext rewrites the compiled list into new buckets, marks every existing bucket deleted and publishes.
+// Consumers then download only the surviving patches, the old buckets are removed by CleanupOldFiles.
+func (m *Master) CompactContext(ctx context.Context) error {
+	if m.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return m.publishWithRebase(ctx, m.compact)
+}
+
+func (m *Master) CompactPartial(buckets int) error {
+	return m.CompactPartialContext(context.Background(), buckets)
+}
+
+// CompactPartialContext merges the live patches of up to the given number of the sparsest buckets into one new
+// bucket, marks them deleted and publishes. The latest bucket is never merged, nor is a bucket whose dead patches
+// still hide patches in a bucket which is not merged, so consumers re-download only the merged buckets.
+func (m *Master) CompactPartialContext(ctx context.Context, buckets int) error {
+	if m.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return m.publishWithRebase(ctx, func() error {
+		return m.compactPartial(buckets)
+	})
+}
+
+// compactIfWasteful compacts when wastage exceeds CompactThreshold, partially when CompactBuckets is set
+func (m *Master) compactIfWasteful() error {
+	if m.CompactThreshold <= 0 {
+		return nil
+	}
+	wastage, e := m.CalculateWastage()
+	if e != nil {
+		return e
+	}
+	if wastage.Percent <= m.CompactThreshold {
+		return nil
+	}
+	m.Logger.InfoF("debug", "wastage of %d%% exceeds %d%%, compacting", wastage.Percent, m.CompactThreshold)
+
+	if m.CompactBuckets > 0 {
+		return m.compactPartial(m.CompactBuckets)
+	}
+
+	return m.compact()
+}
+
+// compact replaces the buckets with new ones holding a single add patch per key in the compiled list, expiring
+// when the key does and leaving out keys which have already expired
+func (m *Master) compact() error {
+	state, e := m.compileState()
+	if e != nil {
+		return e
+	}
+	list := state.listAsOf(m.now())
+	keys := make([]string, 0, len(list))
+	for key := range list {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	deleted := 0
+	for _, bucket := range m.Buckets {
+		if !bucket.IsDeleted {
+			bucket.IsDeleted = true
+			deleted++
+		}
+	}
+
+	// new buckets are numbered after the deleted ones, so consumers never reuse a cached file
+	for _, key := range keys {
+		e = m.addPatch(&DefaultPatch{
+			Action:  "+",
+			Key:     key,
+			Values:  list[key],
+			Expires: state.Expires[key],
+		})
+		if e != nil {
+			return e
+		}
+	}
+	m.Logger.DebugF("debug", "compacted %d buckets into %d keys", deleted, len(keys))
+
+	return nil
+}
+
+// compactPartial moves the live patches of the sparsest buckets into a new bucket, which is replayed last. That
+// is safe because only later patches of the same chain touch a live patch's key and they are moved too, while
+// dead patches are only dropped along with every patch they hide.
+func (m *Master) compactPartial(buckets int) error {
+	report, live, e := m.replayWastage()
+	if e != nil {
+		return e
+	}
+
+	latestNumber := 0
+	for _, bucketWastage := range report.Buckets {
+		if bucketWastage.Number > latestNumber {
+			latestNumber = bucketWastage.Number
+		}
+	}
+	var candidates []*BucketWastage
+	for _, bucketWastage := range report.Buckets {
+		if bucketWastage.Number != latestNumber && bucketWastage.DeadPatches > 0 {
+			candidates = append(candidates, bucketWastage)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].LiveRatio() < candidates[j].LiveRatio()
+	})
+	if len(candidates) > buckets {
+		candidates = candidates[:buckets]
+	}
+
+	merged := make(map[int]bool)
+	for _, bucketWastage := range candidates {
+		merged[bucketWastage.Number] = true
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, bucketWastage := range candidates {
+			if !merged[bucketWastage.Number] {
+				continue
+			}
+			for number := range bucketWastage.requires {
+				if !merged[number] {
+					delete(merged, bucketWastage.Number)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	if len(merged) == 0 {
+		m.Logger.DebugF("debug", "no buckets can be partially compacted")
+		return nil
+	}
+
+	maxBucketNumber := 0
+	var patches []Patch
+	for _, bucket := range m.Buckets {
+		if bucket.Number > maxBucketNumber {
+			maxBucketNumber = bucket.Number
+		}
+		if bucket.IsDeleted || !merged[bucket.Number] {
+			continue
+		}
+		e = bucket.Replay(0, func(index int, patch Patch) error {
+			key, ok := live[patch.GetKey()]
+			if !ok {
+				return nil
+			}
+			for _, current := range key.patches {
+				if current.bucket.Number == bucket.Number && current.index == index {
+					patches = append(patches, patch)
+				}
+			}
+			return nil
+		})
+		if e != nil {
+			return e
+		}
+		bucket.IsDeleted = true
+	}
+
+	if len(patches) > 0 {
+		_, e = m.newBucket(maxBucketNumber + 1)
+		if e != nil {
+			return e
+		}
+	}
+	for _, patch := range patches {
+		e = m.addPatch(patch)
+		if e != nil {
+			return e
+		}
+	}
+	m.Logger.DebugF("debug", "merged %d buckets into %d live patches", len(merged), len(patches))
+
+	return nil
+}
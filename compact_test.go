@@ -0,0 +1,163 @@
+package cbpatch
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// addRandomTestPatches spreads patches of every action over several buckets, so most buckets end up with dead
+// patches which hide or extend patches in other buckets
+func addRandomTestPatches(t *testing.T, m *Master, seed int64) {
+	t.Helper()
+	random := rand.New(rand.NewSource(seed))
+	actions := []Action{
+		ActionAdd,
+		ActionAdd,
+		ActionAdd,
+		ActionRemove,
+		ActionAppend,
+		ActionRemoveValues,
+		ActionSetField,
+		ActionClearPrefix,
+		ActionClearCategory,
+	}
+	for bucketNumber := 1; bucketNumber <= 6; bucketNumber++ {
+		if bucketNumber > 1 {
+			_, e := m.newBucket(bucketNumber)
+			if e != nil {
+				t.Fatal(e)
+			}
+		}
+		for i := 0; i < 40; i++ {
+			key := "c" + strconv.Itoa(random.Intn(3)) + ":" + strconv.Itoa(random.Intn(12))
+			value := strconv.Itoa(random.Intn(4))
+			switch action := actions[random.Intn(len(actions))]; action {
+			case ActionSetField:
+				addTestPatch(t, m, action, key, strconv.Itoa(random.Intn(3)), value)
+			case ActionClearPrefix:
+				addTestPatch(t, m, action, key[:3])
+			case ActionClearCategory:
+				addTestPatch(t, m, action, key[:2])
+			default:
+				addTestPatch(t, m, action, key, value)
+			}
+		}
+	}
+}
+
+func TestMaster_Compact(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+
+	publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), nil)
+	addRandomTestPatches(t, publisher, 1)
+	publishTestMaster(t, publisher)
+	expected := compileTestList(t, publisher)
+
+	e := publisher.Compact()
+	if e != nil {
+		t.Fatal(e)
+	}
+	wastage, e := publisher.CalculateWastage()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if wastage.DeadPatches != 0 || wastage.TotalPatches != len(expected) {
+		t.Errorf("expected one live patch per key, got %d of %d dead", wastage.DeadPatches, wastage.TotalPatches)
+	}
+
+	consumer := downloadTestMaster(t, storage, filepath.Join(dir, "consumer"), nil)
+	if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+}
+
+func TestMaster_CompactPartial(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		dir := newTestDir(t)
+		storage := NewMemoryStorage()
+
+		publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), nil)
+		addRandomTestPatches(t, publisher, seed)
+		publishTestMaster(t, publisher)
+		expected := compileTestList(t, publisher)
+		before, e := publisher.CalculateWastage()
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		e = publisher.CompactPartial(3)
+		if e != nil {
+			t.Fatal(e)
+		}
+		after, e := publisher.CalculateWastage()
+		if e != nil {
+			t.Fatal(e)
+		}
+		if after.DeadPatches > before.DeadPatches {
+			t.Errorf("seed %d: dead patches grew from %d to %d", seed, before.DeadPatches, after.DeadPatches)
+		}
+
+		consumer := downloadTestMaster(t, storage, filepath.Join(dir, "consumer"), nil)
+		if len(consumer.Buckets) >= len(before.Buckets) {
+			t.Errorf("seed %d: no buckets were merged", seed)
+		}
+		if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+			t.Errorf("seed %d: expected %v, got %v", seed, expected, list)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMaster_CalculateWastage_Buckets(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	m := downloadTestMaster(t, NewMemoryStorage(), dir, nil)
+	addTestPatch(t, m, ActionAdd, "a", "1")
+	addTestPatch(t, m, ActionAdd, "b", "1")
+	_, e := m.newBucket(2)
+	if e != nil {
+		t.Fatal(e)
+	}
+	addTestPatch(t, m, ActionAdd, "a", "2")
+	addTestPatch(t, m, ActionAdd, "c", "1")
+
+	report, e := m.CalculateWastage()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if report.LiveKeys != 3 || report.TotalPatches != 4 || report.DeadPatches != 1 {
+		t.Errorf("expected 1 of 4 patches dead over 3 keys, got %+v", report)
+	}
+	if len(report.Buckets) != 2 {
+		t.Fatalf("expected a report for each bucket, got %d", len(report.Buckets))
+	}
+	var bytesWasted int64
+	for _, bucketWastage := range report.Buckets {
+		expectedDead := 0
+		if bucketWastage.Number == 1 {
+			expectedDead = 1
+		}
+		if bucketWastage.Patches != 2 || bucketWastage.DeadPatches != expectedDead ||
+			bucketWastage.LivePatches != 2-expectedDead {
+			t.Errorf("bucket %d: expected %d of 2 patches dead, got %+v", bucketWastage.Number, expectedDead,
+				bucketWastage)
+		}
+		if bucketWastage.Bytes != bucketWastage.LiveBytes+bucketWastage.BytesWasted {
+			t.Errorf("bucket %d: live and wasted bytes do not add up, got %+v", bucketWastage.Number, bucketWastage)
+		}
+		bytesWasted += bucketWastage.BytesWasted
+	}
+	if bytesWasted != report.BytesWasted || bytesWasted == 0 {
+		t.Errorf("expected the buckets to add up to %d wasted bytes, got %d", report.BytesWasted, bytesWasted)
+	}
+	if report.Buckets[0].LiveRatio() >= report.Buckets[1].LiveRatio() {
+		t.Errorf("expected bucket 1 to be sparser than bucket 2")
+	}
+}
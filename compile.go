@@ -0,0 +1,336 @@
+package cbpatch
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// compiledList is the result of CompileList along with the buckets it was built from. The last bucket may still
+// have patches appended, so its size and checksum are kept to recognise when it has only grown.
+type compiledList struct {
+	State        *listState
+	Buckets      []compiledBucket
+	TailSize     int64
+	TailChecksum string
+}
+
+type compiledBucket struct {
+	Number       int
+	UnzippedHash string
+	Patches      int
+}
+
+func newCompiledList(state *listState, buckets []*Bucket) (*compiledList, error) {
+	compiled := &compiledList{
+		State: state,
+	}
+	for _, bucket := range buckets {
+		compiled.Buckets = append(compiled.Buckets, compiledBucket{
+			Number:       bucket.Number,
+			UnzippedHash: bucket.UnzippedHash,
+			Patches:      bucket.PatchCount,
+		})
+	}
+	if len(buckets) == 0 {
+		return compiled, nil
+	}
+
+	var e error
+	compiled.TailSize, compiled.TailChecksum, e = prefixChecksum(buckets[len(buckets)-1], -1)
+	if e != nil {
+		return nil, e
+	}
+
+	return compiled, nil
+}
+
+// resume returns the kept state and the bucket and patch index to continue replaying the buckets from, or a nil
+// state when they must all be replayed
+func (c *compiledList) resume(buckets []*Bucket) (*listState, int, int, error) {
+	if c == nil || len(c.Buckets) == 0 || len(buckets) < len(c.Buckets) {
+		return nil, 0, 0, nil
+	}
+
+	tail := len(c.Buckets) - 1
+	for i, compiled := range c.Buckets[:tail] {
+		bucket := buckets[i]
+		if bucket.Number != compiled.Number ||
+			bucket.UnzippedHash != compiled.UnzippedHash ||
+			bucket.PatchCount != compiled.Patches {
+			return nil, 0, 0, nil
+		}
+	}
+
+	bucket := buckets[tail]
+	if bucket.Number != c.Buckets[tail].Number || bucket.PatchCount < c.Buckets[tail].Patches {
+		return nil, 0, 0, nil
+	}
+	_, checksum, e := prefixChecksum(bucket, c.TailSize)
+	if e != nil {
+		return nil, 0, 0, e
+	}
+	if checksum != c.TailChecksum {
+		return nil, 0, 0, nil
+	}
+
+	return c.State, tail, c.Buckets[tail].Patches, nil
+}
+
+// prefixChecksum returns the checksum of the first size bytes of the unzipped bucket, or of all of it when size is
+// negative, without moving the file's offset. A bucket shorter than size has an empty checksum.
+func prefixChecksum(bucket *Bucket, size int64) (int64, string, error) {
+	info, e := bucket.File.Stat()
+	if e != nil {
+		return 0, "", e
+	}
+	if size < 0 {
+		size = info.Size()
+	}
+	if info.Size() < size {
+		return size, "", nil
+	}
+
+	checksum, e := checksumReadSeeker(io.NewSectionReader(bucket.File, 0, size))
+	if e != nil {
+		return 0, "", e
+	}
+
+	return size, checksum, nil
+}
+
+// CompileListAt returns the list as it was once the first patchIndex patches of the bucket numbered bucketNumber
+// had been applied. Only buckets which are not deleted are replayed, so history merged by compaction is not
+// available. A bucket is uploaded again by every publish which appends to it, so its upload time is only when its
+// patches were applied if they are all compiled. Keys are then left out which had expired by that time, otherwise
+// by the upload of the bucket before it, the latest time the list is known to have been older. Use a master
+// without unpublished patches.
+func (m *Master) CompileListAt(bucketNumber int, patchIndex int) (map[string][]string, error) {
+	var target *Bucket
+	var previous *Bucket
+	for _, bucket := range m.Buckets {
+		if bucket.IsDeleted {
+			continue
+		}
+		if bucket.Number == bucketNumber {
+			target = bucket
+		} else if bucket.Number < bucketNumber && (previous == nil || bucket.Number > previous.Number) {
+			previous = bucket
+		}
+	}
+	if target == nil {
+		e := fmt.Errorf("%w: bucket %d", ErrNotFound, bucketNumber)
+		m.ErrorHandler.Error(e)
+		return nil, e
+	}
+	if patchIndex < 0 || patchIndex > target.PatchCount {
+		e := fmt.Errorf("%w: patch %d of bucket %d which has %d", ErrNotFound, patchIndex, bucketNumber, target.PatchCount)
+		m.ErrorHandler.Error(e)
+		return nil, e
+	}
+
+	var asOf time.Time
+	if patchIndex == target.PatchCount {
+		uploadedAt, ok := target.UploadedAt()
+		if ok {
+			asOf = uploadedAt
+		} else {
+			// the bucket has not been published, so its patches are being applied now
+			asOf = m.now()
+		}
+	} else if previous != nil {
+		// the zero time is kept when it is unknown, leaving out no keys
+		asOf, _ = previous.UploadedAt()
+	}
+
+	return m.compileUntil(asOf, func(bucket *Bucket) int {
+		if bucket.Number == bucketNumber {
+			return patchIndex
+		}
+		if bucket.Number > bucketNumber {
+			return 0
+		}
+		return -1
+	})
+}
+
+func (m *Master) CompileListAtTime(at time.Time) (map[string][]string, error) {
+	return m.CompileListAtTimeContext(context.Background(), at)
+}
+
+// CompileListAtTimeContext returns the list as it was at the given time. The last versioned master published by
+// then holds the exact patch count of each bucket, see RetainedVersions, and its buckets must not have been merged
+// by a compaction since. Without one, as for ReadOnly masters, only the buckets last uploaded by then are replayed.
+// The latest bucket is uploaded again by every publish, so that list is usually missing many patches. Use a master
+// without unpublished patches.
+func (m *Master) CompileListAtTimeContext(ctx context.Context, at time.Time) (map[string][]string, error) {
+	if !m.ReadOnly {
+		versions, e := m.VersionsContext(ctx)
+		if e != nil {
+			return nil, e
+		}
+		version := ""
+		for _, candidate := range versions {
+			unixTime, ok := versionUnixTime(candidate)
+			if !ok {
+				continue
+			}
+			if !time.Unix(unixTime, 0).After(at) {
+				version = candidate
+			}
+		}
+		if version != "" {
+			return m.compileVersion(ctx, version, at)
+		}
+	}
+
+	m.Logger.DebugF("debug", "no versioned master published by %s, replaying buckets by upload time", at)
+	return m.compileUntil(at, func(bucket *Bucket) int {
+		uploadedAt, ok := bucket.UploadedAt()
+		if ok && uploadedAt.After(at) {
+			return 0
+		}
+		return -1
+	})
+}
+
+// compileVersion replays the patches of the buckets which were published by a versioned master. Patches are only
+// appended, so each bucket's patch count in the version is a cut point. A bucket uploaded since the version may
+// have had patches appended, or be a new bucket reusing the number after a Rollback, so its first patches must
+// still have the checksum the version recorded.
+func (m *Master) compileVersion(ctx context.Context, version string, asOf time.Time) (map[string][]string, error) {
+	rows, e := m.readVersion(ctx, version)
+	if e != nil {
+		m.ErrorHandler.Error(e)
+		return nil, e
+	}
+
+	malformedRow := func(lineNumber int, reason string, e error) error {
+		return &MalformedRowError{Path: m.versionPath(version), Line: lineNumber, Reason: reason, Err: e}
+	}
+	patchCounts := make(map[int]int)
+	versionRows := make(map[int][]string)
+	for i, row := range rows {
+		if len(row) != 6 || row[0] == "-1" {
+			continue
+		}
+		bucketNumber, e := strconv.Atoi(row[0])
+		if e != nil {
+			return nil, malformedRow(i+1, "invalid bucket number", e)
+		}
+		patchCounts[bucketNumber], e = strconv.Atoi(row[5])
+		if e != nil {
+			return nil, malformedRow(i+1, "invalid patch count", e)
+		}
+		versionRows[bucketNumber] = row
+	}
+	buckets := make(map[int]*Bucket)
+	for _, bucket := range m.Buckets {
+		if !bucket.IsDeleted {
+			buckets[bucket.Number] = bucket
+		}
+	}
+	for bucketNumber, row := range versionRows {
+		bucket, ok := buckets[bucketNumber]
+		if !ok || bucket.PatchCount < patchCounts[bucketNumber] {
+			e = fmt.Errorf("%w: bucket %d of version %s has since been compacted", ErrNotFound, bucketNumber, version)
+			m.ErrorHandler.Error(e)
+			return nil, e
+		}
+		if bucket.RelativeFilePath == row[1] {
+			continue
+		}
+		checksum, e := patchesChecksum(bucket, patchCounts[bucketNumber])
+		if e != nil {
+			m.ErrorHandler.Error(e)
+			return nil, e
+		}
+		if checksum != row[4] {
+			e = fmt.Errorf("%w: bucket %d of version %s has since been replaced", ErrNotFound, bucketNumber, version)
+			m.ErrorHandler.Error(e)
+			return nil, e
+		}
+	}
+
+	m.Logger.DebugF("debug", "compiling list as published by version %s", version)
+	return m.compileUntil(asOf, func(bucket *Bucket) int {
+		return patchCounts[bucket.Number]
+	})
+}
+
+// patchesChecksum returns the checksum the unzipped bucket had when it held only its first patches, by writing
+// them as the bucket file would
+func patchesChecksum(bucket *Bucket, patches int) (string, error) {
+	hash := md5.New()
+	writer := csv.NewWriter(hash)
+	stop := errors.New("stop")
+	e := bucket.Replay(0, func(index int, patch Patch) error {
+		if index == patches {
+			return stop
+		}
+
+		return writer.Write(patchRow(patch))
+	})
+	if e != nil && e != stop {
+		return "", e
+	}
+	writer.Flush()
+	e = writer.Error()
+	if e != nil {
+		return "", e
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// compileUntil replays limit(bucket) patches of each bucket which is not deleted, in order, or all of them when it
+// returns -1. The kept compiled list is neither used nor replaced.
+func (m *Master) compileUntil(asOf time.Time, limit func(bucket *Bucket) int) (map[string][]string, error) {
+	state := newListState()
+	stop := errors.New("stop")
+	for _, bucket := range m.Buckets {
+		if bucket.IsDeleted {
+			continue
+		}
+		patches := limit(bucket)
+		if patches == 0 {
+			continue
+		}
+		e := bucket.Replay(0, func(index int, patch Patch) error {
+			if index == patches {
+				return stop
+			}
+			state.apply(patch, m.keyCategory())
+
+			return nil
+		})
+		if e != nil && e != stop {
+			m.ErrorHandler.Error(e)
+			return nil, e
+		}
+	}
+
+	return state.listAsOf(asOf), nil
+}
+
+// UploadedAt returns the time of the publish which last uploaded the bucket, taken from the unix time which
+// starts its RelativeFilePath. It is false for buckets which have not been uploaded, or were uploaded by a
+// version which did not prefix the path.
+func (b *Bucket) UploadedAt() (time.Time, bool) {
+	index := strings.Index(b.RelativeFilePath, "-")
+	if index < 0 {
+		return time.Time{}, false
+	}
+	unixTime, e := strconv.ParseInt(b.RelativeFilePath[:index], 10, 64)
+	if e != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(unixTime, 0), true
+}
@@ -0,0 +1,356 @@
+package cbpatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingLogger keeps every debug message
+type recordingLogger struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (r *recordingLogger) InfoF(category string, message string, args ...interface{}) {}
+
+func (r *recordingLogger) DebugF(category string, message string, args ...interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.messages = append(r.messages, fmt.Sprintf(message, args...))
+}
+
+func (r *recordingLogger) Count(prefix string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	count := 0
+	for _, message := range r.messages {
+		if strings.HasPrefix(message, prefix) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestMaster_CompileList_Resume(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		dir := newTestDir(t)
+		logger := &recordingLogger{}
+		m := downloadTestMaster(t, NewMemoryStorage(), dir, func(config *Config) {
+			config.Logger = logger
+			config.StreamPatches = stream
+		})
+
+		addTestPatch(t, m, ActionAdd, "a", "1")
+		addTestPatch(t, m, ActionAdd, "b", "1")
+		compileTestList(t, m)
+		addTestPatch(t, m, ActionAppend, "a", "2")
+		addTestPatch(t, m, ActionRemove, "b")
+		compileTestList(t, m)
+		_, e := m.newBucket(2)
+		if e != nil {
+			t.Fatal(e)
+		}
+		addTestPatch(t, m, ActionAppend, "a", "3")
+		addTestPatch(t, m, ActionAdd, "c", "1")
+		list := compileTestList(t, m)
+
+		if count := logger.Count("resuming compiled list"); count != 2 {
+			t.Errorf("stream %t: expected both later compiles to resume, got %d", stream, count)
+		}
+		expected := map[string][]string{"a": {"1", "2", "3"}, "c": {"1"}}
+		if !reflect.DeepEqual(list, expected) {
+			t.Errorf("stream %t: expected %v, got %v", stream, expected, list)
+		}
+
+		// an earlier bucket which changed is replayed from scratch
+		m.Buckets[0].UnzippedHash = "changed"
+		list = compileTestList(t, m)
+		if count := logger.Count("resuming compiled list"); count != 2 {
+			t.Errorf("stream %t: expected a changed bucket not to resume, got %d resumes", stream, count)
+		}
+		if !reflect.DeepEqual(list, expected) {
+			t.Errorf("stream %t: expected %v, got %v", stream, expected, list)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMaster_CompileList_FailedReplay(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	m := downloadTestMaster(t, NewMemoryStorage(), dir, func(config *Config) {
+		config.StreamPatches = true
+	})
+
+	addTestPatch(t, m, ActionAdd, "a", "1")
+	compileTestList(t, m)
+	addTestPatch(t, m, ActionAppend, "a", "2")
+
+	// a row which cannot be read stops the replay after the append patch was applied
+	bucket := m.Buckets[0]
+	info, e := bucket.File.Stat()
+	if e != nil {
+		t.Fatal(e)
+	}
+	file, e := os.OpenFile(bucket.File.Name(), os.O_APPEND|os.O_WRONLY, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = file.WriteString("+,\"broken\n")
+	file.Close()
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = m.CompileList()
+	var malformed *MalformedRowError
+	if !errors.As(e, &malformed) {
+		t.Fatalf("expected a MalformedRowError, got %v", e)
+	}
+
+	e = bucket.File.Truncate(info.Size())
+	if e != nil {
+		t.Fatal(e)
+	}
+	expected := map[string][]string{"a": {"1", "2"}}
+	if list := compileTestList(t, m); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected the append to be applied once, got %v", list)
+	}
+}
+
+func TestMaster_StreamPatches(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+
+	publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), nil)
+	addRandomTestPatches(t, publisher, 1)
+	publishTestMaster(t, publisher)
+	expected := compileTestList(t, publisher)
+
+	consumer := downloadTestMaster(t, storage, filepath.Join(dir, "consumer"), func(config *Config) {
+		config.StreamPatches = true
+	})
+	for i, bucket := range consumer.Buckets {
+		if len(bucket.Patches) != 0 {
+			t.Errorf("bucket %d: expected no patches in memory, got %d", bucket.Number, len(bucket.Patches))
+		}
+		if bucket.PatchCount != publisher.Buckets[i].PatchCount {
+			t.Errorf("bucket %d: expected %d patches, got %d", bucket.Number, publisher.Buckets[i].PatchCount,
+				bucket.PatchCount)
+		}
+	}
+	if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+
+	// patches added while streaming are written to the file only
+	addTestPatch(t, consumer, ActionAdd, "streamed", "1")
+	latest := consumer.Buckets[len(consumer.Buckets)-1]
+	if len(latest.Patches) != 0 {
+		t.Errorf("expected the added patch not to be kept in memory")
+	}
+	if list := compileTestList(t, consumer); !reflect.DeepEqual(list["streamed"], []string{"1"}) {
+		t.Errorf("expected the added patch to be compiled, got %v", list["streamed"])
+	}
+}
+
+func TestMaster_Replay(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		dir := newTestDir(t)
+		m := downloadTestMaster(t, NewMemoryStorage(), dir, func(config *Config) {
+			config.StreamPatches = stream
+		})
+		addTestPatch(t, m, ActionAdd, "deleted", "1")
+		_, e := m.newBucket(2)
+		if e != nil {
+			t.Fatal(e)
+		}
+		addTestPatch(t, m, ActionAdd, "a", "1")
+		addTestPatch(t, m, ActionAppend, "a", "2")
+		_, e = m.newBucket(3)
+		if e != nil {
+			t.Fatal(e)
+		}
+		addTestPatch(t, m, ActionRemove, "a")
+		m.Buckets[0].IsDeleted = true
+
+		var replayed []string
+		e = m.Replay(func(patch Patch) error {
+			replayed = append(replayed, patch.GetAction()+patch.GetKey())
+			return nil
+		})
+		if e != nil {
+			t.Fatal(e)
+		}
+		expected := []string{"+a", string(ActionAppend) + "a", string(ActionRemove) + "a"}
+		if !reflect.DeepEqual(replayed, expected) {
+			t.Errorf("stream %t: expected %v, got %v", stream, expected, replayed)
+		}
+
+		failure := errors.New("stop")
+		calls := 0
+		e = m.Replay(func(patch Patch) error {
+			calls++
+			return failure
+		})
+		if e != failure || calls != 1 {
+			t.Errorf("stream %t: expected the first error to stop the replay, got %v after %d calls", stream, e,
+				calls)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMaster_CompileListAt(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	m := downloadTestMaster(t, NewMemoryStorage(), dir, nil)
+
+	e := m.AddPatch(&DefaultPatch{
+		Action:  string(ActionAdd),
+		Key:     "expired",
+		Values:  []string{"1"},
+		Expires: time.Now().Add(-time.Hour),
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	addTestPatch(t, m, ActionAdd, "a", "1")
+	publishTestMaster(t, m)
+	_, e = m.newBucket(2)
+	if e != nil {
+		t.Fatal(e)
+	}
+	addTestPatch(t, m, ActionAdd, "b", "1")
+	addTestPatch(t, m, ActionRemove, "a")
+	publishTestMaster(t, m)
+
+	for _, test := range []struct {
+		bucketNumber int
+		patchIndex   int
+		expected     map[string][]string
+	}{
+		// a prefix of the first bucket has no earlier upload to leave expired keys out by
+		{1, 1, map[string][]string{"expired": {"1"}}},
+		{1, 2, map[string][]string{"a": {"1"}}},
+		{2, 0, map[string][]string{"a": {"1"}}},
+		{2, 1, map[string][]string{"a": {"1"}, "b": {"1"}}},
+		{2, 2, map[string][]string{"b": {"1"}}},
+	} {
+		list, e := m.CompileListAt(test.bucketNumber, test.patchIndex)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if !reflect.DeepEqual(list, test.expected) {
+			t.Errorf("bucket %d patch %d: expected %v, got %v", test.bucketNumber, test.patchIndex, test.expected,
+				list)
+		}
+	}
+
+	for _, at := range [][2]int{{3, 0}, {1, 3}, {2, -1}} {
+		_, e = m.CompileListAt(at[0], at[1])
+		if !errors.Is(e, ErrNotFound) {
+			t.Errorf("bucket %d patch %d: expected ErrNotFound, got %v", at[0], at[1], e)
+		}
+	}
+}
+
+func TestMaster_CompileListAtTime(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	m := downloadTestMaster(t, NewMemoryStorage(), dir, func(config *Config) {
+		config.RetainedVersions = 10
+	})
+	ctx := context.Background()
+
+	addTestPatch(t, m, ActionAdd, "a", "1")
+	publishTestMaster(t, m)
+	// the bucket is uploaded again with the patch appended, the first version still only holds one patch
+	addTestPatch(t, m, ActionAdd, "b", "1")
+	publishTestMaster(t, m)
+
+	versions, e := m.Versions()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("expected 2 versions, got %v", versions)
+	}
+	list, e := m.compileVersion(ctx, versions[0], time.Now())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if expected := map[string][]string{"a": {"1"}}; !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+	list, e = m.CompileListAtTime(time.Now().Add(time.Hour))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if expected := map[string][]string{"a": {"1"}, "b": {"1"}}; !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+	_, e = m.CompileListAtTime(time.Now().Add(-time.Hour))
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestMaster_CompileListAtTime_ReusedBucketNumber(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	m := downloadTestMaster(t, NewMemoryStorage(), dir, func(config *Config) {
+		config.RetainedVersions = 10
+	})
+	ctx := context.Background()
+
+	addTestPatch(t, m, ActionAdd, "a", "1")
+	publishTestMaster(t, m)
+	// compaction moves the key into bucket 2, which is then numbered 2 again after rolling back to bucket 1
+	e := m.Compact()
+	if e != nil {
+		t.Fatal(e)
+	}
+	versions, e := m.Versions()
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = m.Rollback(versions[0])
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = m.newBucket(2)
+	if e != nil {
+		t.Fatal(e)
+	}
+	addTestPatch(t, m, ActionAdd, "z", "9")
+	publishTestMaster(t, m)
+
+	versions, e = m.Versions()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(versions) != 4 {
+		t.Fatalf("expected 4 versions, got %v", versions)
+	}
+	_, e = m.compileVersion(ctx, versions[1], time.Now())
+	if !errors.Is(e, ErrNotFound) {
+		t.Errorf("expected the replaced bucket to be refused with ErrNotFound, got %v", e)
+	}
+	list, e := m.compileVersion(ctx, versions[2], time.Now())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if expected := map[string][]string{"a": {"1"}}; !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected the rolled back version to be compiled, got %v", list)
+	}
+}
@@ -0,0 +1,57 @@
+package cbpatch
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// contextReader fails reads once its context is done, allowing long copies to be cancelled part way through
+type contextReader struct {
+	Ctx    context.Context
+	Reader io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	e := c.Ctx.Err()
+	if e != nil {
+		return 0, e
+	}
+
+	return c.Reader.Read(p)
+}
+
+// copyContext is io.Copy which stops with the context's error once the context is done
+func copyContext(ctx context.Context, writer io.Writer, reader io.Reader) (int64, error) {
+	return io.Copy(writer, &contextReader{Ctx: ctx, Reader: reader})
+}
+
+type contextReadCloser struct {
+	contextReader
+	Closer io.Closer
+}
+
+func (c *contextReadCloser) Close() error {
+	return c.Closer.Close()
+}
+
+// newContextReadCloser wraps a ReadCloser so reads fail once the context is done
+func newContextReadCloser(ctx context.Context, readCloser io.ReadCloser) io.ReadCloser {
+	return &contextReadCloser{
+		contextReader: contextReader{Ctx: ctx, Reader: readCloser},
+		Closer:        readCloser,
+	}
+}
+
+// sleepContext sleeps for the duration, returning the context's error early if it is done first
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,161 @@
+package cbpatch
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a remote object, such as a bucket or the master, does not exist
+	ErrNotFound = errors.New("cbpatch: not found")
+	// ErrObjectNotExist is returned by Storage implementations when the requested object does not exist
+	ErrObjectNotExist = ErrNotFound
+	// ErrChecksumMismatch is matched by every ChecksumMismatchError
+	ErrChecksumMismatch = errors.New("cbpatch: checksum mismatch")
+	// ErrMalformedRow is matched by every MalformedRowError
+	ErrMalformedRow = errors.New("cbpatch: malformed row")
+	// ErrValidation is matched by every ValidationError
+	ErrValidation = errors.New("cbpatch: validation failed")
+	// ErrReadOnly is returned when attempting to modify a read only Master
+	ErrReadOnly = errors.New("cbpatch: master is read only")
+	// ErrConflict is returned when a conditional upload's precondition fails, it is matched by every ConflictError
+	ErrConflict = errors.New("cbpatch: precondition failed")
+	// ErrInterruptedPublish is returned when publishing while a previous publish has not been recovered
+	ErrInterruptedPublish = errors.New("cbpatch: a previous publish was interrupted, call RecoverPublish")
+	// ErrInvalidPatch is matched by every InvalidPatchError
+	ErrInvalidPatch = errors.New("cbpatch: invalid patch")
+	// ErrLocked is matched by every LockedError
+	ErrLocked = errors.New("cbpatch: publish lock is held by another owner")
+	// ErrLockNotHeld is returned when publishing with a PublishLock which has not been acquired
+	ErrLockNotHeld = errors.New("cbpatch: publish lock not held")
+	// ErrLockLost is returned when a held PublishLock was taken over or could not be renewed before it expired
+	ErrLockLost = errors.New("cbpatch: publish lock lost")
+)
+
+// ConflictError is returned when publishing fails because the remote master is no longer the version which was
+// downloaded, meaning another publisher has written it in the meantime
+type ConflictError struct {
+	Path         string
+	Precondition Precondition
+}
+
+func (c *ConflictError) Error() string {
+	return fmt.Sprintf(
+		"remote master %s changed since it was downloaded (generation %d, etag %s)",
+		c.Path,
+		c.Precondition.Generation,
+		c.Precondition.Etag,
+	)
+}
+
+func (c *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// InvalidPatchError is returned when adding a patch whose action is unknown or whose key or values do not suit it
+type InvalidPatchError struct {
+	Key    string
+	Action string
+	Reason string
+}
+
+func (i *InvalidPatchError) Error() string {
+	return fmt.Sprintf("invalid patch %q for key %q: %s", i.Action, i.Key, i.Reason)
+}
+
+func (i *InvalidPatchError) Is(target error) bool {
+	return target == ErrInvalidPatch
+}
+
+// LockedError is returned when the context passed to PublishLock.Acquire is done while another owner holds the
+// lock. Err is the context's error.
+type LockedError struct {
+	Path    string
+	Owner   string
+	Expires time.Time
+	Err     error
+}
+
+func (l *LockedError) Error() string {
+	return fmt.Sprintf(
+		"publish lock %s is held by %s until %s: %s",
+		l.Path,
+		l.Owner,
+		l.Expires.Format(time.RFC3339),
+		l.Err.Error(),
+	)
+}
+
+func (l *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+func (l *LockedError) Unwrap() error {
+	return l.Err
+}
+
+// ChecksumMismatchError is returned when a downloaded file does not match the checksum recorded in the master
+type ChecksumMismatchError struct {
+	Path     string
+	Zipped   bool
+	Expected string
+	Actual   string
+}
+
+func (c *ChecksumMismatchError) Error() string {
+	kind := "unzipped"
+	if c.Zipped {
+		kind = "zipped"
+	}
+
+	return fmt.Sprintf("invalid %s checksum for %s: expected %s, got %s", kind, c.Path, c.Expected, c.Actual)
+}
+
+func (c *ChecksumMismatchError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// MalformedRowError is returned when a row of a master, bucket or categories csv cannot be understood.
+// Line is the 1-based row number within the file.
+type MalformedRowError struct {
+	Path   string
+	Line   int
+	Reason string
+	Err    error
+}
+
+func (m *MalformedRowError) Error() string {
+	if m.Err != nil {
+		return fmt.Sprintf("malformed row %d in %s: %s: %s", m.Line, m.Path, m.Reason, m.Err.Error())
+	}
+
+	return fmt.Sprintf("malformed row %d in %s: %s", m.Line, m.Path, m.Reason)
+}
+
+func (m *MalformedRowError) Is(target error) bool {
+	return target == ErrMalformedRow
+}
+
+func (m *MalformedRowError) Unwrap() error {
+	return m.Err
+}
+
+// ValidationError wraps an error returned by the configured validation function for a bucket row
+type ValidationError struct {
+	Path string
+	Line int
+	Err  error
+}
+
+func (v *ValidationError) Error() string {
+	return fmt.Sprintf("validation failed for row %d in %s: %s", v.Line, v.Path, v.Err.Error())
+}
+
+func (v *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+func (v *ValidationError) Unwrap() error {
+	return v.Err
+}
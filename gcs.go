@@ -0,0 +1,144 @@
+package cbpatch
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"io"
+	"net/http"
+)
+
+// GcsStorage adapts a Google Cloud Storage client to the Storage interface
+type GcsStorage struct {
+	Client *storage.Client
+}
+
+func NewGcsStorage(client *storage.Client) *GcsStorage {
+	return &GcsStorage{
+		Client: client,
+	}
+}
+
+func (g *GcsStorage) DownloadWriter(ctx context.Context, bucket string, name string, writer io.Writer) error {
+	reader, e := g.GetDownloadReader(ctx, bucket, name)
+	if e != nil {
+		return e
+	}
+	defer reader.Close()
+
+	_, e = copyContext(ctx, writer, reader)
+	return e
+}
+
+func (g *GcsStorage) GetUploadWriter(ctx context.Context, bucket string, name string) (io.WriteCloser, error) {
+	return g.Client.Bucket(bucket).Object(name).NewWriter(ctx), nil
+}
+
+func (g *GcsStorage) GetConditionalUploadWriter(
+	ctx context.Context,
+	bucket string,
+	name string,
+	precondition Precondition,
+) (ConditionalWriter, error) {
+	conditions := storage.Conditions{DoesNotExist: true}
+	if precondition.Generation != 0 {
+		conditions = storage.Conditions{GenerationMatch: precondition.Generation}
+	}
+
+	return &gcsConditionalWriter{
+		Writer: g.Client.Bucket(bucket).Object(name).If(conditions).NewWriter(ctx),
+	}, nil
+}
+
+func (g *GcsStorage) MakePublic(ctx context.Context, bucket string, name string) error {
+	return g.Client.Bucket(bucket).Object(name).ACL().Set(
+		ctx,
+		storage.AllUsers,
+		storage.RoleReader,
+	)
+}
+
+func (g *GcsStorage) GetDownloadReader(ctx context.Context, bucket string, name string) (io.ReadCloser, error) {
+	reader, e := g.Client.Bucket(bucket).Object(name).NewReader(ctx)
+	if e != nil {
+		return nil, gcsError(e)
+	}
+
+	return reader, nil
+}
+
+func (g *GcsStorage) Ls(ctx context.Context, bucket string, dir string) ([]*ObjectInfo, error) {
+	var objects []*ObjectInfo
+	it := g.Client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: dir})
+	for true {
+		attrs, e := it.Next()
+		if e == iterator.Done {
+			break
+		}
+		if e != nil {
+			return nil, gcsError(e)
+		}
+
+		objects = append(objects, &ObjectInfo{
+			Name:       attrs.Name,
+			Size:       attrs.Size,
+			Created:    attrs.Created,
+			Generation: attrs.Generation,
+			Etag:       attrs.Etag,
+		})
+	}
+
+	return objects, nil
+}
+
+func (g *GcsStorage) Delete(ctx context.Context, bucket string, filePath string) error {
+	return gcsError(g.Client.Bucket(bucket).Object(filePath).Delete(ctx))
+}
+
+// PublicUrl returns the plain HTTPS URL an object can be fetched from once it has been made public
+func (g *GcsStorage) PublicUrl(bucket string, name string) string {
+	return fmt.Sprintf("https://storage.googleapis.com/%s/%s", bucket, name)
+}
+
+// gcsError translates GCS specific errors into their cbpatch equivalents
+func gcsError(e error) error {
+	if errors.Is(e, storage.ErrObjectNotExist) {
+		return ErrObjectNotExist
+	}
+	var apiError *googleapi.Error
+	if errors.As(e, &apiError) && apiError.Code == http.StatusPreconditionFailed {
+		return ErrConflict
+	}
+
+	return e
+}
+
+type gcsConditionalWriter struct {
+	Writer *storage.Writer
+}
+
+func (w *gcsConditionalWriter) Write(p []byte) (int, error) {
+	return w.Writer.Write(p)
+}
+
+func (w *gcsConditionalWriter) Close() error {
+	return gcsError(w.Writer.Close())
+}
+
+func (w *gcsConditionalWriter) Object() *ObjectInfo {
+	attrs := w.Writer.Attrs()
+	if attrs == nil {
+		return nil
+	}
+
+	return &ObjectInfo{
+		Name:       attrs.Name,
+		Size:       attrs.Size,
+		Created:    attrs.Created,
+		Generation: attrs.Generation,
+		Etag:       attrs.Etag,
+	}
+}
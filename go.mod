@@ -5,4 +5,5 @@ go 1.13
 require (
 	cloud.google.com/go/storage v1.5.0
 	github.com/codingbeard/cbutil v0.2.1
+	google.golang.org/api v0.15.0
 )
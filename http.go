@@ -0,0 +1,130 @@
+package cbpatch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HttpStatusError is returned when a public object is fetched and the server responds with a non 2xx status.
+// A 404 status matches ErrObjectNotExist with errors.Is.
+type HttpStatusError struct {
+	Url        string
+	StatusCode int
+	Status     string
+}
+
+func (h *HttpStatusError) Error() string {
+	return fmt.Sprintf("http status %s for %s", h.Status, h.Url)
+}
+
+func (h *HttpStatusError) Is(target error) bool {
+	return target == ErrObjectNotExist && h.StatusCode == http.StatusNotFound
+}
+
+// Temporary reports whether the request may succeed if retried
+func (h *HttpStatusError) Temporary() bool {
+	return h.StatusCode >= 500 || h.StatusCode == http.StatusTooManyRequests
+}
+
+// HttpDownloader fetches public objects over plain HTTP(S), retrying failed requests and remembering
+// the ETag of each URL so unchanged objects can be skipped with If-None-Match
+type HttpDownloader struct {
+	Client     *http.Client
+	Retries    int
+	RetryDelay time.Duration
+	Logger     Logger
+	mutex      sync.Mutex
+	etags      map[string]string
+}
+
+func NewHttpDownloader(client *http.Client, retries int, retryDelay time.Duration, logger Logger) *HttpDownloader {
+	return &HttpDownloader{
+		Client:     client,
+		Retries:    retries,
+		RetryDelay: retryDelay,
+		Logger:     logger,
+		etags:      make(map[string]string),
+	}
+}
+
+// Download fetches the object at url. When conditional is true and the server reports the object has not changed
+// since it was last downloaded, modified is false and no body is returned.
+func (h *HttpDownloader) Download(ctx context.Context, url string, conditional bool) (body []byte, modified bool, e error) {
+	for attempt := 0; attempt <= h.Retries; attempt++ {
+		if attempt > 0 {
+			delay := h.RetryDelay * time.Duration(1<<uint(attempt-1))
+			h.Logger.DebugF("debug", "retrying download in %s: %s: %s", delay, url, e.Error())
+			sleepE := sleepContext(ctx, delay)
+			if sleepE != nil {
+				return nil, false, sleepE
+			}
+		}
+
+		var retry bool
+		body, modified, retry, e = h.download(ctx, url, conditional)
+		if e == nil || !retry {
+			return body, modified, e
+		}
+	}
+
+	return nil, false, e
+}
+
+func (h *HttpDownloader) download(
+	ctx context.Context,
+	url string,
+	conditional bool,
+) (body []byte, modified bool, retry bool, e error) {
+	request, e := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if e != nil {
+		return nil, false, false, e
+	}
+
+	h.mutex.Lock()
+	etag := h.etags[url]
+	h.mutex.Unlock()
+	if conditional && etag != "" {
+		request.Header.Set("If-None-Match", etag)
+	}
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, e := client.Do(request)
+	if e != nil {
+		return nil, false, ctx.Err() == nil, e
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		return nil, false, false, nil
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		statusError := &HttpStatusError{
+			Url:        url,
+			StatusCode: response.StatusCode,
+			Status:     response.Status,
+		}
+		return nil, false, statusError.Temporary(), statusError
+	}
+
+	body, e = ioutil.ReadAll(response.Body)
+	if e != nil {
+		return nil, false, ctx.Err() == nil, e
+	}
+
+	h.mutex.Lock()
+	if responseEtag := response.Header.Get("ETag"); responseEtag != "" {
+		h.etags[url] = responseEtag
+	} else {
+		delete(h.etags, url)
+	}
+	h.mutex.Unlock()
+
+	return body, true, false, nil
+}
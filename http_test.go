@@ -0,0 +1,224 @@
+package cbpatch
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPublicServer serves the objects of a MemoryStorage at /{bucket}/{name} as a public bucket would, answering
+// If-None-Match with 304. Statuses queued with Fail are returned instead, one per request.
+type testPublicServer struct {
+	storage  *MemoryStorage
+	server   *httptest.Server
+	mutex    sync.Mutex
+	requests []string
+	statuses []int
+}
+
+func newTestPublicServer(storage *MemoryStorage) *testPublicServer {
+	s := &testPublicServer{storage: storage}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+
+	return s
+}
+
+func (s *testPublicServer) Close() {
+	s.server.Close()
+}
+
+// Configure points a master at the server instead of its Storage
+func (s *testPublicServer) Configure(config *Config) {
+	config.PublicUrlTemplate = s.server.URL + "/{bucket}/{name}"
+}
+
+func (s *testPublicServer) Fail(statuses ...int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.statuses = append(s.statuses, statuses...)
+}
+
+// Requests returns the path of every request so far
+func (s *testPublicServer) Requests() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]string(nil), s.requests...)
+}
+
+func (s *testPublicServer) serve(writer http.ResponseWriter, request *http.Request) {
+	s.mutex.Lock()
+	s.requests = append(s.requests, request.URL.Path)
+	status := 0
+	if len(s.statuses) > 0 {
+		status = s.statuses[0]
+		s.statuses = s.statuses[1:]
+	}
+	s.mutex.Unlock()
+	if status != 0 {
+		writer.WriteHeader(status)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(request.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	data, ok := s.storage.Get(parts[0], parts[1])
+	if !ok {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	etag := fmt.Sprintf("\"%x\"", md5.Sum(data))
+	if request.Header.Get("If-None-Match") == etag {
+		writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writer.Header().Set("ETag", etag)
+	writer.Write(data)
+}
+
+func TestMaster_ReadOnly_Http(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+	server := newTestPublicServer(storage)
+	defer server.Close()
+
+	publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), nil)
+	addTestPatch(t, publisher, ActionAdd, "first", "1")
+	_, e := publisher.newBucket(2)
+	if e != nil {
+		t.Fatal(e)
+	}
+	addTestPatch(t, publisher, ActionAdd, "second", "2")
+	publishTestMaster(t, publisher)
+
+	// a ReadOnly master needs no Storage credentials
+	consumer := downloadTestMaster(t, nil, filepath.Join(dir, "consumer"), func(config *Config) {
+		server.Configure(config)
+		config.ReadOnly = true
+	})
+	expected := map[string][]string{"first": {"1"}, "second": {"2"}}
+	if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 3 {
+		t.Errorf("expected the master and 2 buckets to be fetched, got %v", requests)
+	}
+	e = consumer.AddPatch(&DefaultPatch{Action: string(ActionAdd), Key: "third", Values: []string{"3"}})
+	if e != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", e)
+	}
+}
+
+func TestMaster_DownloadContext_HttpStatus(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+	server := newTestPublicServer(storage)
+	defer server.Close()
+	readOnly := func(config *Config) {
+		server.Configure(config)
+		config.ReadOnly = true
+		config.HttpDownloader = NewHttpDownloader(nil, 2, time.Millisecond, testLogger{})
+	}
+
+	// a master which has not been published yet is empty
+	consumer := newTestMaster(t, nil, filepath.Join(dir, "empty"), readOnly)
+	if len(consumer.Buckets) != 0 || consumer.Version != "" {
+		t.Errorf("expected an empty master, got version %q with %d buckets", consumer.Version, len(consumer.Buckets))
+	}
+
+	publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), nil)
+	addTestPatch(t, publisher, ActionAdd, "key", "value")
+	publishTestMaster(t, publisher)
+
+	// server errors are retried
+	server.Fail(http.StatusInternalServerError, http.StatusServiceUnavailable)
+	consumer = downloadTestMaster(t, nil, filepath.Join(dir, "retried"), readOnly)
+	expected := map[string][]string{"key": {"value"}}
+	if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+
+	// client errors are not
+	server.Fail(http.StatusForbidden)
+	config := testConfig(nil, filepath.Join(dir, "forbidden"))
+	readOnly(&config)
+	consumer = NewMaster(config)
+	e := os.MkdirAll(consumer.Dir, os.ModePerm)
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = consumer.Init()
+	if e != nil {
+		t.Fatal(e)
+	}
+	requests := len(server.Requests())
+	e = consumer.Download()
+	var statusError *HttpStatusError
+	if !errors.As(e, &statusError) || statusError.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected an HttpStatusError 403, got %v", e)
+	}
+	if attempts := len(server.Requests()) - requests; attempts != 1 {
+		t.Errorf("expected a single attempt, got %d", attempts)
+	}
+}
+
+func TestMaster_Public_Http(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+	server := newTestPublicServer(storage)
+	defer server.Close()
+	public := func(config *Config) {
+		server.Configure(config)
+		config.Public = true
+	}
+
+	first := downloadTestMaster(t, storage, filepath.Join(dir, "first"), public)
+	second := downloadTestMaster(t, storage, filepath.Join(dir, "second"), public)
+	// the writers download the master over HTTP, and only read it from the Storage when publishing
+	requests := server.Requests()
+	if len(requests) != 2 || requests[0] != "/bucket/lists/master.csv" {
+		t.Errorf("expected both writers to fetch the master over HTTP, got %v", requests)
+	}
+	if calls := storage.Calls(); len(calls) != 0 {
+		t.Errorf("expected the Storage not to be used when downloading, got %v", calls)
+	}
+
+	addTestPatch(t, first, ActionAdd, "first", "1")
+	publishTestMaster(t, first)
+	if !storage.IsPublic("bucket", "lists/master.csv") {
+		t.Error("expected the master to be public")
+	}
+
+	addTestPatch(t, second, ActionAdd, "second", "2")
+	e := second.UploadToStorageBucket()
+	var conflict *ConflictError
+	if !errors.As(e, &conflict) {
+		t.Fatalf("expected a ConflictError, got %v", e)
+	}
+
+	consumer := downloadTestMaster(t, nil, filepath.Join(dir, "consumer"), func(config *Config) {
+		server.Configure(config)
+		config.ReadOnly = true
+	})
+	expected := map[string][]string{"first": {"1"}}
+	if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+}
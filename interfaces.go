@@ -2,12 +2,13 @@ package cbpatch
 
 import (
 	"bytes"
-	"cloud.google.com/go/storage"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"runtime"
 	"strings"
+	"time"
 )
 
 type ErrorHandler interface {
@@ -43,13 +44,74 @@ func (d defaultLogger) DebugF(category string, message string, args ...interface
 	log.Println(category+":", fmt.Sprintf(message, args...))
 }
 
+// ObjectInfo describes an object held by a Storage backend
+type ObjectInfo struct {
+	Name       string
+	Size       int64
+	Created    time.Time
+	Generation int64
+	Etag       string
+}
+
+// Precondition restricts a conditional upload to a specific version of the existing object. Backends compare
+// whichever of Generation or Etag they support, the zero Precondition requires that the object does not exist.
+type Precondition struct {
+	Generation int64
+	Etag       string
+}
+
+// PreconditionFor returns the Precondition matching an existing object, or requiring no object when it is nil
+func PreconditionFor(object *ObjectInfo) Precondition {
+	if object == nil {
+		return Precondition{}
+	}
+
+	return Precondition{
+		Generation: object.Generation,
+		Etag:       object.Etag,
+	}
+}
+
+// sameObject reports whether two preconditions describe the same version of an object. Backends do not report
+// every field everywhere, S3 writers have no Generation, so only the fields both carry are compared.
+func (p Precondition) sameObject(other Precondition) bool {
+	if p.Generation != 0 && other.Generation != 0 {
+		return p.Generation == other.Generation
+	}
+	if p.Etag != "" && other.Etag != "" {
+		return p.Etag == other.Etag
+	}
+
+	return p == other
+}
+
+// ConditionalWriter is returned by Storage.GetConditionalUploadWriter. Close returns ErrConflict when the
+// precondition no longer holds, after a successful Close Object describes the written object.
+type ConditionalWriter interface {
+	io.WriteCloser
+	Object() *ObjectInfo
+}
+
+// Storage is a remote object store. Cancelling the context passed to an upload or download aborts the transfer,
+// an upload is only committed when its writer is closed without error.
 type Storage interface {
-	DownloadWriter(bucket string, name string, writer io.Writer) error
-	GetUploadWriter(bucket string, name string) (*storage.Writer, error)
-	MakePublic(bucket string, name string) error
-	GetDownloadReader(bucket string, name string) (io.ReadCloser, error)
-	Ls(bucket string, dir string) ([]*storage.ObjectAttrs, error)
-	Delete(bucket string, filePath string) error
+	DownloadWriter(ctx context.Context, bucket string, name string, writer io.Writer) error
+	GetUploadWriter(ctx context.Context, bucket string, name string) (io.WriteCloser, error)
+	GetConditionalUploadWriter(
+		ctx context.Context,
+		bucket string,
+		name string,
+		precondition Precondition,
+	) (ConditionalWriter, error)
+	MakePublic(ctx context.Context, bucket string, name string) error
+	GetDownloadReader(ctx context.Context, bucket string, name string) (io.ReadCloser, error)
+	Ls(ctx context.Context, bucket string, dir string) ([]*ObjectInfo, error)
+	Delete(ctx context.Context, bucket string, filePath string) error
+}
+
+// PublicUrlStorage is implemented by Storage backends whose public objects can be fetched over plain HTTP(S)
+type PublicUrlStorage interface {
+	PublicUrl(bucket string, name string) string
 }
 
 type CategoriesItem interface {
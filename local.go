@@ -0,0 +1,303 @@
+package cbpatch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	localTempPrefix  = ".cbpatch-upload-"
+	localLockTimeout = time.Minute
+)
+
+// LocalStorage is a Storage implementation backed by a directory tree on the local filesystem.
+// Storage bucket names map to top level directories within Root and object names to paths relative to them.
+type LocalStorage struct {
+	Root string
+}
+
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{
+		Root: root,
+	}
+}
+
+func (l *LocalStorage) DownloadWriter(ctx context.Context, bucket string, name string, writer io.Writer) error {
+	reader, e := l.GetDownloadReader(ctx, bucket, name)
+	if e != nil {
+		return e
+	}
+	defer reader.Close()
+
+	_, e = copyContext(ctx, writer, reader)
+	return e
+}
+
+func (l *LocalStorage) GetUploadWriter(ctx context.Context, bucket string, name string) (io.WriteCloser, error) {
+	e := ctx.Err()
+	if e != nil {
+		return nil, e
+	}
+
+	filePath, e := l.objectPath(bucket, name)
+	if e != nil {
+		return nil, e
+	}
+
+	e = os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+	if e != nil {
+		return nil, e
+	}
+
+	// write to a temporary file in the same directory so readers never see a partial object
+	file, e := ioutil.TempFile(filepath.Dir(filePath), localTempPrefix)
+	if e != nil {
+		return nil, e
+	}
+
+	return &localWriter{
+		Ctx:      ctx,
+		Name:     name,
+		File:     file,
+		FilePath: filePath,
+	}, nil
+}
+
+func (l *LocalStorage) GetConditionalUploadWriter(
+	ctx context.Context,
+	bucket string,
+	name string,
+	precondition Precondition,
+) (ConditionalWriter, error) {
+	writer, e := l.GetUploadWriter(ctx, bucket, name)
+	if e != nil {
+		return nil, e
+	}
+	localWriter := writer.(*localWriter)
+	localWriter.Precondition = &precondition
+
+	return localWriter, nil
+}
+
+// MakePublic is a no-op, every object in a LocalStorage is readable by anyone with access to Root
+func (l *LocalStorage) MakePublic(ctx context.Context, bucket string, name string) error {
+	e := ctx.Err()
+	if e != nil {
+		return e
+	}
+
+	filePath, e := l.objectPath(bucket, name)
+	if e != nil {
+		return e
+	}
+
+	_, e = os.Stat(filePath)
+	if os.IsNotExist(e) {
+		return ErrObjectNotExist
+	}
+
+	return e
+}
+
+func (l *LocalStorage) GetDownloadReader(ctx context.Context, bucket string, name string) (io.ReadCloser, error) {
+	e := ctx.Err()
+	if e != nil {
+		return nil, e
+	}
+
+	filePath, e := l.objectPath(bucket, name)
+	if e != nil {
+		return nil, e
+	}
+
+	file, e := os.Open(filePath)
+	if os.IsNotExist(e) {
+		return nil, ErrObjectNotExist
+	}
+	if e != nil {
+		return nil, e
+	}
+
+	return newContextReadCloser(ctx, file), nil
+}
+
+func (l *LocalStorage) Ls(ctx context.Context, bucket string, dir string) ([]*ObjectInfo, error) {
+	bucketPath, e := l.objectPath(bucket, "")
+	if e != nil {
+		return nil, e
+	}
+
+	var objects []*ObjectInfo
+	e = filepath.Walk(bucketPath, func(filePath string, info os.FileInfo, e error) error {
+		if e != nil {
+			if os.IsNotExist(e) {
+				return nil
+			}
+			return e
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), localTempPrefix) {
+			return nil
+		}
+
+		relativePath, e := filepath.Rel(bucketPath, filePath)
+		if e != nil {
+			return e
+		}
+		name := filepath.ToSlash(relativePath)
+		if !strings.HasPrefix(name, dir) {
+			return nil
+		}
+
+		objects = append(objects, &ObjectInfo{
+			Name:       name,
+			Size:       info.Size(),
+			Created:    info.ModTime(),
+			Generation: info.ModTime().UnixNano(),
+		})
+
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	return objects, nil
+}
+
+func (l *LocalStorage) Delete(ctx context.Context, bucket string, filePath string) error {
+	e := ctx.Err()
+	if e != nil {
+		return e
+	}
+
+	objectPath, e := l.objectPath(bucket, filePath)
+	if e != nil {
+		return e
+	}
+
+	e = os.Remove(objectPath)
+	if os.IsNotExist(e) {
+		return ErrObjectNotExist
+	}
+
+	return e
+}
+
+// objectPath resolves an object name to a path within Root, refusing names which would escape the bucket directory
+func (l *LocalStorage) objectPath(bucket string, name string) (string, error) {
+	if bucket == "" || strings.ContainsAny(bucket, `/\`) || bucket == "." || bucket == ".." {
+		return "", fmt.Errorf("invalid local storage bucket name: %s", bucket)
+	}
+
+	cleaned := filepath.Clean(filepath.FromSlash("/" + name))
+	if strings.HasPrefix(filepath.Base(cleaned), localTempPrefix) {
+		return "", fmt.Errorf("invalid local storage object name: %s", name)
+	}
+
+	return filepath.Join(l.Root, bucket, cleaned), nil
+}
+
+type localWriter struct {
+	Ctx          context.Context
+	Name         string
+	File         *os.File
+	FilePath     string
+	Precondition *Precondition
+	object       *ObjectInfo
+}
+
+func (w *localWriter) Write(p []byte) (int, error) {
+	e := w.Ctx.Err()
+	if e != nil {
+		return 0, e
+	}
+
+	return w.File.Write(p)
+}
+
+// Close commits the upload by renaming the temporary file into place, unless the context has been cancelled
+func (w *localWriter) Close() error {
+	e := w.File.Close()
+	if e == nil {
+		e = w.Ctx.Err()
+	}
+	if e != nil {
+		os.Remove(w.File.Name())
+		return e
+	}
+
+	if w.Precondition != nil {
+		e = w.commitConditional()
+	} else {
+		e = os.Rename(w.File.Name(), w.FilePath)
+	}
+	if e != nil {
+		os.Remove(w.File.Name())
+		return e
+	}
+
+	return nil
+}
+
+// commitConditional renames the temporary file into place while holding a lock file, provided the existing object
+// still matches the precondition. Generations are the modification time of the object in nanoseconds.
+func (w *localWriter) commitConditional() error {
+	lockPath := filepath.Join(filepath.Dir(w.FilePath), localTempPrefix+"lock-"+filepath.Base(w.FilePath))
+	lock, e := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.ModePerm)
+	if os.IsExist(e) {
+		// a lock left behind by a crashed writer is removed, the next attempt can then proceed
+		info, statE := os.Stat(lockPath)
+		if statE == nil && time.Since(info.ModTime()) > localLockTimeout {
+			os.Remove(lockPath)
+		}
+		return ErrConflict
+	}
+	if e != nil {
+		return e
+	}
+	lock.Close()
+	defer os.Remove(lockPath)
+
+	info, e := os.Stat(w.FilePath)
+	if e != nil && !os.IsNotExist(e) {
+		return e
+	}
+	if os.IsNotExist(e) {
+		if w.Precondition.Generation != 0 {
+			return ErrConflict
+		}
+	} else if w.Precondition.Generation != info.ModTime().UnixNano() {
+		return ErrConflict
+	}
+
+	e = os.Rename(w.File.Name(), w.FilePath)
+	if e != nil {
+		return e
+	}
+
+	info, e = os.Stat(w.FilePath)
+	if e != nil {
+		return e
+	}
+	w.object = &ObjectInfo{
+		Name:       w.Name,
+		Size:       info.Size(),
+		Created:    info.ModTime(),
+		Generation: info.ModTime().UnixNano(),
+	}
+
+	return nil
+}
+
+func (w *localWriter) Object() *ObjectInfo {
+	return w.object
+}
@@ -0,0 +1,173 @@
+package cbpatch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLocalStorage(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewLocalStorage(dir)
+	ctx := context.Background()
+
+	for _, name := range []string{"lists/1.csv.zlib", "lists/2.csv.zlib", "other/1.csv.zlib"} {
+		e := putTestObject(t, storage, name, name)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	// an upload in progress is not listed
+	writer, e := storage.GetUploadWriter(ctx, "bucket", "lists/3.csv.zlib")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	objects, e := storage.Ls(ctx, "bucket", "lists/")
+	if e != nil {
+		t.Fatal(e)
+	}
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+		if object.Created.IsZero() || object.Generation == 0 {
+			t.Errorf("%s: expected a creation time and generation, got %+v", object.Name, object)
+		}
+	}
+	expected := []string{"lists/1.csv.zlib", "lists/2.csv.zlib"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+	e = writer.Close()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var buffer bytes.Buffer
+	e = storage.DownloadWriter(ctx, "bucket", "lists/1.csv.zlib", &buffer)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if buffer.String() != "lists/1.csv.zlib" {
+		t.Errorf("downloaded %q", buffer.String())
+	}
+
+	e = storage.Delete(ctx, "bucket", "lists/1.csv.zlib")
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = storage.DownloadWriter(ctx, "bucket", "lists/1.csv.zlib", ioutil.Discard)
+	if !errors.Is(e, ErrObjectNotExist) {
+		t.Errorf("expected ErrObjectNotExist downloading, got %v", e)
+	}
+	e = storage.Delete(ctx, "bucket", "lists/1.csv.zlib")
+	if !errors.Is(e, ErrObjectNotExist) {
+		t.Errorf("expected ErrObjectNotExist deleting, got %v", e)
+	}
+	e = storage.MakePublic(ctx, "bucket", "lists/1.csv.zlib")
+	if !errors.Is(e, ErrObjectNotExist) {
+		t.Errorf("expected ErrObjectNotExist making public, got %v", e)
+	}
+}
+
+func TestLocalStorage_objectPath(t *testing.T) {
+	storage := NewLocalStorage("/root")
+
+	filePath, e := storage.objectPath("bucket", "../../etc/passwd")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if filePath != filepath.Join("/root", "bucket", "etc", "passwd") {
+		t.Errorf("expected the name to stay within the bucket, got %s", filePath)
+	}
+	for _, bucket := range []string{"", ".", "..", "a/b"} {
+		_, e = storage.objectPath(bucket, "name")
+		if e == nil {
+			t.Errorf("expected bucket %q to be refused", bucket)
+		}
+	}
+	_, e = storage.objectPath("bucket", "lists/"+localTempPrefix+"1")
+	if e == nil {
+		t.Error("expected a temporary file name to be refused")
+	}
+}
+
+func TestLocalStorage_GetConditionalUploadWriter(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewLocalStorage(dir)
+	ctx := context.Background()
+	upload := func(precondition Precondition, content string) (*ObjectInfo, error) {
+		writer, e := storage.GetConditionalUploadWriter(ctx, "bucket", "lists/master.csv", precondition)
+		if e != nil {
+			return nil, e
+		}
+		_, e = writer.Write([]byte(content))
+		if e != nil {
+			return nil, e
+		}
+		e = writer.Close()
+		return writer.Object(), e
+	}
+
+	first, e := upload(Precondition{}, "first")
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = upload(Precondition{}, "again")
+	if !errors.Is(e, ErrConflict) {
+		t.Errorf("expected ErrConflict creating an existing object, got %v", e)
+	}
+	_, e = upload(PreconditionFor(first), "second")
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = upload(PreconditionFor(first), "stale")
+	if !errors.Is(e, ErrConflict) {
+		t.Errorf("expected ErrConflict replacing a stale object, got %v", e)
+	}
+
+	var buffer bytes.Buffer
+	e = storage.DownloadWriter(ctx, "bucket", "lists/master.csv", &buffer)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if buffer.String() != "second" {
+		t.Errorf("expected the second upload to be kept, got %q", buffer.String())
+	}
+	files, e := filepath.Glob(filepath.Join(dir, "bucket", "lists", localTempPrefix+"*"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected failed uploads to be removed, got %v", files)
+	}
+}
+
+func TestLocalStorage_ReadOnlyMaster(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewLocalStorage(filepath.Join(dir, "storage"))
+
+	publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), nil)
+	addTestPatch(t, publisher, ActionAdd, "key", "value")
+	publishTestMaster(t, publisher)
+
+	// LocalStorage has no public URLs, so a ReadOnly master reads it directly
+	consumer := downloadTestMaster(t, storage, filepath.Join(dir, "consumer"), func(config *Config) {
+		config.ReadOnly = true
+	})
+	if consumer.HttpDownloader != nil {
+		t.Error("expected no HttpDownloader")
+	}
+	expected := map[string][]string{"key": {"value"}}
+	if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+}
@@ -0,0 +1,404 @@
+package cbpatch
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLockTtl        = time.Minute
+	defaultLockRetryDelay = time.Second
+)
+
+// PublishLock serialises publishers of the same master. Acquire blocks until the lock is held or the context is
+// done, Err returns nil for as long as the lock is still held and Release gives it up.
+type PublishLock interface {
+	Acquire(ctx context.Context) error
+	Err() error
+	Release(ctx context.Context) error
+}
+
+// lease is the content of a lock object, a single csv row of the owner, expiry and last heartbeat
+type lease struct {
+	Owner     string
+	Expires   time.Time
+	Heartbeat time.Time
+}
+
+// StorageLock is a PublishLock held as a lease object in a Storage. The lease is written with conditional uploads
+// and renewed every HeartbeatInterval while held. A lease which has not been renewed for Ttl is stale and is taken
+// over by the next owner to acquire it, so the clocks of publishers should be roughly in sync.
+type StorageLock struct {
+	StorageBucketName string
+	RemoteFilePath    string
+	Owner             string
+	Ttl               time.Duration
+	HeartbeatInterval time.Duration
+	RetryDelay        time.Duration
+	ErrorHandler      ErrorHandler
+	Logger            Logger
+	Storage           Storage
+	mutex             sync.Mutex
+	held              bool
+	lost              error
+	renewed           time.Time
+	precondition      Precondition
+	stopHeartbeat     context.CancelFunc
+	heartbeatDone     chan struct{}
+}
+
+// NewStorageLock creates a lock held as the lease object remoteFilePath. An owner unique to this process is
+// generated when owner is empty, and the lease expires after one minute without a heartbeat when ttl is zero.
+func NewStorageLock(
+	errorHandler ErrorHandler,
+	logger Logger,
+	storage Storage,
+	storageBucketName,
+	remoteFilePath,
+	owner string,
+	ttl time.Duration,
+) *StorageLock {
+	if owner == "" {
+		owner = defaultLockOwner()
+	}
+	if ttl == 0 {
+		ttl = defaultLockTtl
+	}
+
+	return &StorageLock{
+		ErrorHandler:      errorHandler,
+		Logger:            logger,
+		Storage:           storage,
+		StorageBucketName: storageBucketName,
+		RemoteFilePath:    remoteFilePath,
+		Owner:             owner,
+		Ttl:               ttl,
+		HeartbeatInterval: ttl / 3,
+		RetryDelay:        defaultLockRetryDelay,
+	}
+}
+
+// NewLocalLock creates a lock held as a lease file on the local filesystem, for tests and publishers which share
+// a disk
+func NewLocalLock(errorHandler ErrorHandler, logger Logger, filePath, owner string, ttl time.Duration) *StorageLock {
+	dir := filepath.Dir(filePath)
+
+	return NewStorageLock(
+		errorHandler,
+		logger,
+		NewLocalStorage(filepath.Dir(dir)),
+		filepath.Base(dir),
+		filepath.Base(filePath),
+		owner,
+		ttl,
+	)
+}
+
+// Acquire writes a lease for Owner once the current lease is released, expired or already Owner's, waiting
+// RetryDelay between attempts. A LockedError is returned if the context is done while another owner holds it.
+func (s *StorageLock) Acquire(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.held && s.lost == nil {
+		return nil
+	}
+	s.stop()
+
+	for true {
+		object, current, e := s.readLease(ctx)
+		if e != nil {
+			s.ErrorHandler.Error(e)
+			return e
+		}
+
+		now := time.Now()
+		if current == nil || current.Owner == s.Owner || now.After(current.Expires) {
+			if current != nil && current.Owner != s.Owner {
+				s.Logger.InfoF("debug", "taking over stale publish lock %s from %s", s.RemoteFilePath, current.Owner)
+			}
+			e = s.writeLease(ctx, PreconditionFor(object))
+			if e == nil {
+				break
+			}
+			if !errors.Is(e, ErrConflict) {
+				s.ErrorHandler.Error(e)
+				return e
+			}
+			// another owner wrote the lease first, read it again after waiting
+			current = &lease{}
+		}
+
+		s.Logger.DebugF("debug", "publish lock %s is held by %s, waiting", s.RemoteFilePath, current.Owner)
+		e = sleepContext(ctx, s.RetryDelay)
+		if e != nil {
+			return &LockedError{
+				Path:    s.RemoteFilePath,
+				Owner:   current.Owner,
+				Expires: current.Expires,
+				Err:     e,
+			}
+		}
+	}
+
+	s.Logger.DebugF("debug", "acquired publish lock %s as %s", s.RemoteFilePath, s.Owner)
+	s.held = true
+	s.lost = nil
+	heartbeatCtx, cancel := context.WithCancel(context.Background())
+	s.stopHeartbeat = cancel
+	s.heartbeatDone = make(chan struct{})
+	go s.heartbeat(heartbeatCtx, s.heartbeatDone)
+
+	return nil
+}
+
+// Err returns ErrLockNotHeld before the lock is acquired or after it is released, and ErrLockLost once the lease
+// has been taken over or could not be renewed within Ttl
+func (s *StorageLock) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.held {
+		return ErrLockNotHeld
+	}
+	if s.lost != nil {
+		return s.lost
+	}
+	if time.Since(s.renewed) >= s.Ttl {
+		return ErrLockLost
+	}
+
+	return nil
+}
+
+// Release stops the heartbeat and deletes the lease, provided it is still the one written by this lock.
+// ErrLockLost is returned if it was not.
+func (s *StorageLock) Release(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.held {
+		return nil
+	}
+	s.stop()
+	s.held = false
+	if s.lost != nil {
+		return s.lost
+	}
+
+	object, _, e := s.readLease(ctx)
+	if e != nil {
+		s.ErrorHandler.Error(e)
+		return e
+	}
+	if !PreconditionFor(object).sameObject(s.precondition) {
+		return ErrLockLost
+	}
+
+	e = s.Storage.Delete(ctx, s.StorageBucketName, s.RemoteFilePath)
+	if e != nil && !errors.Is(e, ErrObjectNotExist) {
+		s.ErrorHandler.Error(e)
+		return e
+	}
+	s.Logger.DebugF("debug", "released publish lock %s", s.RemoteFilePath)
+
+	return nil
+}
+
+// stop cancels the heartbeat and waits for it to finish, it must be called with the mutex held
+func (s *StorageLock) stop() {
+	if s.stopHeartbeat == nil {
+		return
+	}
+
+	s.stopHeartbeat()
+	// the heartbeat needs the mutex to finish a renewal in progress
+	s.mutex.Unlock()
+	<-s.heartbeatDone
+	s.mutex.Lock()
+	s.stopHeartbeat = nil
+	s.heartbeatDone = nil
+}
+
+func (s *StorageLock) heartbeat(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	for true {
+		if sleepContext(ctx, s.HeartbeatInterval) != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		e := s.writeLease(ctx, s.precondition)
+		if e != nil && ctx.Err() == nil {
+			if errors.Is(e, ErrConflict) || time.Since(s.renewed) >= s.Ttl {
+				s.Logger.InfoF("debug", "lost publish lock %s: %s", s.RemoteFilePath, e.Error())
+				s.lost = ErrLockLost
+				s.mutex.Unlock()
+				return
+			}
+			s.ErrorHandler.Error(e)
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// readLease returns the current lease object and its content, or nils when there is no lease
+func (s *StorageLock) readLease(ctx context.Context) (*ObjectInfo, *lease, error) {
+	files, e := s.Storage.Ls(ctx, s.StorageBucketName, s.RemoteFilePath)
+	if e != nil {
+		return nil, nil, e
+	}
+	var object *ObjectInfo
+	for _, file := range files {
+		if file.Name == s.RemoteFilePath {
+			object = file
+		}
+	}
+	if object == nil {
+		return nil, nil, nil
+	}
+
+	var buffer bytes.Buffer
+	e = s.Storage.DownloadWriter(ctx, s.StorageBucketName, s.RemoteFilePath, &buffer)
+	if errors.Is(e, ErrObjectNotExist) {
+		return nil, nil, nil
+	}
+	if e != nil {
+		return nil, nil, e
+	}
+
+	line, e := csv.NewReader(&buffer).Read()
+	if e != nil {
+		return nil, nil, &MalformedRowError{Path: s.RemoteFilePath, Line: 1, Reason: "unreadable csv", Err: e}
+	}
+	if len(line) != 3 {
+		return nil, nil, &MalformedRowError{Path: s.RemoteFilePath, Line: 1, Reason: "lease was not 3 columns"}
+	}
+	expires, e := strconv.ParseInt(line[1], 10, 64)
+	if e != nil {
+		return nil, nil, &MalformedRowError{Path: s.RemoteFilePath, Line: 1, Reason: "invalid expiry", Err: e}
+	}
+	heartbeat, e := strconv.ParseInt(line[2], 10, 64)
+	if e != nil {
+		return nil, nil, &MalformedRowError{Path: s.RemoteFilePath, Line: 1, Reason: "invalid heartbeat", Err: e}
+	}
+
+	return object, &lease{
+		Owner:     line[0],
+		Expires:   time.Unix(0, expires),
+		Heartbeat: time.Unix(0, heartbeat),
+	}, nil
+}
+
+// writeLease writes a lease for Owner expiring Ttl from now, provided the lease object matches the precondition
+func (s *StorageLock) writeLease(ctx context.Context, precondition Precondition) error {
+	now := time.Now()
+	var buffer bytes.Buffer
+	leaseCsv := csv.NewWriter(&buffer)
+	e := leaseCsv.Write([]string{
+		s.Owner,
+		strconv.FormatInt(now.Add(s.Ttl).UnixNano(), 10),
+		strconv.FormatInt(now.UnixNano(), 10),
+	})
+	if e != nil {
+		return e
+	}
+	leaseCsv.Flush()
+	e = leaseCsv.Error()
+	if e != nil {
+		return e
+	}
+
+	storageWriter, e := s.Storage.GetConditionalUploadWriter(ctx, s.StorageBucketName, s.RemoteFilePath, precondition)
+	if e != nil {
+		return e
+	}
+	_, e = storageWriter.Write(buffer.Bytes())
+	if e != nil {
+		storageWriter.Close()
+		return e
+	}
+	e = storageWriter.Close()
+	if e != nil {
+		return e
+	}
+
+	s.precondition = PreconditionFor(storageWriter.Object())
+	s.renewed = now
+
+	return nil
+}
+
+// defaultLockOwner identifies this process by its host name, pid and a random suffix
+func defaultLockOwner() string {
+	hostname, e := os.Hostname()
+	if e != nil {
+		hostname = "unknown"
+	}
+	suffix := make([]byte, 4)
+	_, e = rand.Read(suffix)
+	if e != nil {
+		return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+func (m *Master) AcquirePublishLock() error {
+	return m.AcquirePublishLockContext(context.Background())
+}
+
+// AcquirePublishLockContext blocks until the PublishLock is held, call it before Download. It does nothing when no
+// PublishLock is configured.
+func (m *Master) AcquirePublishLockContext(ctx context.Context) error {
+	if m.ReadOnly {
+		return ErrReadOnly
+	}
+	if m.PublishLock == nil {
+		return nil
+	}
+
+	return m.PublishLock.Acquire(ctx)
+}
+
+func (m *Master) ReleasePublishLock() error {
+	return m.ReleasePublishLockContext(context.Background())
+}
+
+// ReleasePublishLockContext gives up the PublishLock, call it after UploadToStorageBucket and CleanupOldFiles
+func (m *Master) ReleasePublishLockContext(ctx context.Context) error {
+	if m.PublishLock == nil {
+		return nil
+	}
+
+	return m.PublishLock.Release(ctx)
+}
+
+// checkPublishLock returns the error of the PublishLock, if one is configured and it is not held
+func (m *Master) checkPublishLock() error {
+	if m.PublishLock == nil {
+		return nil
+	}
+
+	e := m.PublishLock.Err()
+	if e != nil {
+		m.ErrorHandler.Error(e)
+	}
+
+	return e
+}
+
+func (m *Master) publishLockPath() string {
+	return joinPath(m.RemoteDir, m.FileName+".lock")
+}
@@ -0,0 +1,169 @@
+package cbpatch
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewLocalLock(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	filePath := filepath.Join(dir, "bucket", "master.csv.lock")
+
+	first := NewLocalLock(testErrorHandler{}, testLogger{}, filePath, "first", 0)
+	second := NewLocalLock(testErrorHandler{}, testLogger{}, filePath, "second", 0)
+	second.RetryDelay = 5 * time.Millisecond
+	if first.Err() != ErrLockNotHeld {
+		t.Errorf("expected ErrLockNotHeld before acquiring, got %v", first.Err())
+	}
+
+	e := first.Acquire(ctx)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if first.Err() != nil {
+		t.Errorf("expected the lock to be held, got %v", first.Err())
+	}
+	_, e = os.Stat(filePath)
+	if e != nil {
+		t.Errorf("expected the lease file to be written: %v", e)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	e = second.Acquire(timeout)
+	var locked *LockedError
+	if !errors.As(e, &locked) || !errors.Is(e, ErrLocked) {
+		t.Fatalf("expected a LockedError, got %v", e)
+	}
+	if locked.Owner != "first" || !errors.Is(e, context.DeadlineExceeded) {
+		t.Errorf("expected the lock to be held by first until the deadline, got %v", e)
+	}
+
+	e = first.Release(ctx)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if first.Err() != ErrLockNotHeld {
+		t.Errorf("expected ErrLockNotHeld after releasing, got %v", first.Err())
+	}
+	e = second.Acquire(ctx)
+	if e != nil {
+		t.Fatalf("expected a released lock to be acquired, got %v", e)
+	}
+	e = second.Release(ctx)
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = os.Stat(filePath)
+	if !os.IsNotExist(e) {
+		t.Errorf("expected the lease file to be deleted, got %v", e)
+	}
+}
+
+func TestStorageLock_Takeover(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+
+	// a lease left behind by a publisher which crashed without releasing it
+	crashed := NewStorageLock(testErrorHandler{}, testLogger{}, storage, "bucket", "lists/master.csv.lock", "crashed",
+		20*time.Millisecond)
+	e := crashed.writeLease(ctx, Precondition{})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	lock := NewStorageLock(testErrorHandler{}, testLogger{}, storage, "bucket", "lists/master.csv.lock", "next", 0)
+	lock.RetryDelay = 5 * time.Millisecond
+	timeout, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	started := time.Now()
+	e = lock.Acquire(timeout)
+	if e != nil {
+		t.Fatalf("expected the stale lease to be taken over, got %v", e)
+	}
+	if time.Since(started) < 10*time.Millisecond {
+		t.Error("expected the lease to be taken over only once it expired")
+	}
+	_, current, e := lock.readLease(ctx)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if current.Owner != "next" {
+		t.Errorf("expected the lease to be owned by next, got %s", current.Owner)
+	}
+	e = lock.Release(ctx)
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestStorageLock_Heartbeat(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+
+	lock := NewStorageLock(testErrorHandler{}, testLogger{}, storage, "bucket", "lists/master.csv.lock", "owner",
+		60*time.Millisecond)
+	e := lock.Acquire(ctx)
+	if e != nil {
+		t.Fatal(e)
+	}
+	// the heartbeat keeps renewing the lease past its ttl
+	time.Sleep(100 * time.Millisecond)
+	if lock.Err() != nil {
+		t.Fatalf("expected the lease to be renewed, got %v", lock.Err())
+	}
+
+	// another owner overwrites the lease, so the next renewal conflicts
+	storage.Put("bucket", "lists/master.csv.lock", []byte("other,0,0\n"))
+	deadline := time.Now().Add(time.Second)
+	for lock.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if lock.Err() != ErrLockLost {
+		t.Fatalf("expected ErrLockLost, got %v", lock.Err())
+	}
+	e = lock.Release(ctx)
+	if e != ErrLockLost {
+		t.Errorf("expected releasing a lost lock to return ErrLockLost, got %v", e)
+	}
+	if data, _ := storage.Get("bucket", "lists/master.csv.lock"); string(data) != "other,0,0\n" {
+		t.Errorf("expected the other owner's lease to be kept, got %q", data)
+	}
+}
+
+func TestMaster_PublishLock(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+
+	m := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), func(config *Config) {
+		config.PublishLockTtl = time.Minute
+	})
+	addTestPatch(t, m, ActionAdd, "key", "value")
+	e := m.UploadToStorageBucket()
+	if e != ErrLockNotHeld {
+		t.Errorf("expected ErrLockNotHeld publishing without the lock, got %v", e)
+	}
+
+	e = m.AcquirePublishLock()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, ok := storage.Get("bucket", "lists/master.csv.lock"); !ok {
+		t.Error("expected the lease to be written beside the master")
+	}
+	publishTestMaster(t, m)
+	e = m.ReleasePublishLock()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, ok := storage.Get("bucket", "lists/master.csv.lock"); ok {
+		t.Error("expected the lease to be deleted")
+	}
+}
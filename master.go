@@ -1,40 +1,65 @@
 package cbpatch
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/csv"
-	"fmt"
+	"encoding/hex"
+	"errors"
 	"github.com/codingbeard/cbutil"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	masterFilename = "master.csv"
+	masterFilename        = "master.csv"
+	defaultHttpRetries    = 3
+	defaultHttpRetryDelay = time.Second
+	defaultHttpTimeout    = time.Minute
 )
 
 type Master struct {
-	StorageBucketName string
-	RemoteDir         string
-	Dir               string
-	FileName          string
-	Public            bool
-	File              *os.File
-	Categories        *Categories
-	CategoryItems     []CategoriesItem
-	IsChanged         bool
-	Version           string
-	UnixTime          int64
-	DateTime          string
-	Validation        func(line []string, bucket *Bucket) error
-	Buckets           []*Bucket
-	ErrorHandler      ErrorHandler
-	Logger            Logger
-	Storage           Storage
+	StorageBucketName   string
+	RemoteDir           string
+	Dir                 string
+	FileName            string
+	Public              bool
+	File                *os.File
+	Categories          *Categories
+	CategoryItems       []CategoriesItem
+	IsChanged           bool
+	Version             string
+	UnixTime            int64
+	DateTime            string
+	Precondition        Precondition
+	PendingPatches      []Patch
+	RebaseAttempts      int
+	CompactThreshold    int
+	CompactBuckets      int
+	Validation          func(line []string, bucket *Bucket) error
+	Buckets             []*Bucket
+	StreamPatches       bool
+	KeyCategory         func(key string) string
+	Clock               func() time.Time
+	compiled            *compiledList
+	PublicUrlResolver   PublicUrlResolver
+	NoCacheBuster       bool
+	ReadOnly            bool
+	HttpDownloader      *HttpDownloader
+	DownloadConcurrency int
+	UploadConcurrency   int
+	PublishLock         PublishLock
+	RetainedVersions    int
+	ErrorHandler        ErrorHandler
+	Logger              Logger
+	Storage             Storage
 }
 
 type Config struct {
@@ -42,26 +67,126 @@ type Config struct {
 	RemoteDir         string
 	Dir               string
 	FileName          string
-	Public            bool
-	Validation        func(line []string, bucket *Bucket) error
-	CategoryItems     []CategoriesItem
-	ErrorHandler      ErrorHandler
-	Logger            Logger
-	Storage           Storage
+	// Public makes published objects public, and the master is then downloaded over HTTP(S) as for ReadOnly masters.
+	// Publishes check the Storage still holds the downloaded master, so a stale cached copy causes a ConflictError.
+	Public bool
+	// Validation is given every bucket row as it is verified, with the expiry of an expiring patch removed from
+	// the action column
+	Validation    func(line []string, bucket *Bucket) error
+	CategoryItems []CategoriesItem
+	// PublicUrlTemplate builds public URLs from {bucket} and {name}, see NewPublicUrlTemplate
+	PublicUrlTemplate string
+	// PublicUrlResolver returns public URLs, asking the Storage when nil and PublicUrlTemplate is empty
+	PublicUrlResolver PublicUrlResolver
+	// NoCacheBuster stops ReadOnly masters appending the time to the master URL
+	NoCacheBuster bool
+	// ReadOnly masters download over HTTP(S) and do not need a Storage, unless the Storage has no public URLs and
+	// none are configured, as for LocalStorage, in which case it is read directly
+	ReadOnly bool
+	// HttpRetries is how many times server errors are retried, 3 when zero
+	HttpRetries int
+	// HttpClient is used for HTTP(S) downloads, one with a one minute timeout when nil
+	HttpClient *http.Client
+	// HttpDownloader can be shared by successive ReadOnly masters to reuse its ETags
+	HttpDownloader *HttpDownloader
+	// DownloadConcurrency limits how many buckets DownloadBuckets processes at once, one at a time when zero
+	DownloadConcurrency int
+	// UploadConcurrency limits how many buckets UploadToStorageBucket processes at once, one at a time when zero
+	UploadConcurrency int
+	// RebaseAttempts is how many times UploadToStorageBucket rebases and retries when another publisher wins
+	RebaseAttempts int
+	// PublishLock serialises publishers, see AcquirePublishLock
+	PublishLock PublishLock
+	// PublishLockTtl creates a StorageLock beside the remote master when PublishLock is nil
+	PublishLockTtl time.Duration
+	// CompactThreshold compacts before publishing once CalculateWastage reports a greater Percent, never when zero
+	CompactThreshold int
+	// CompactBuckets merges only this many of the sparsest buckets when compacting, see CompactPartial
+	CompactBuckets int
+	// StreamPatches leaves Bucket.Patches empty and reads patches from the bucket files when they are replayed
+	StreamPatches bool
+	// KeyCategory decides which keys a clear category patch removes, DefaultKeyCategory when nil. Every reader of
+	// the master must use the same one.
+	KeyCategory func(key string) string
+	// Clock decides which patches have expired, time.Now when nil. See ExpiringPatch for how expiries are stored.
+	Clock func() time.Time
+	// RetainedVersions makes every publish also write an immutable versioned master, CleanupOldFiles keeps this
+	// many along with their buckets for Rollback
+	RetainedVersions int
+	ErrorHandler     ErrorHandler
+	Logger           Logger
+	Storage          Storage
 }
 
 func NewMaster(config Config) *Master {
 	master := Master{
-		StorageBucketName: config.StorageBucketName,
-		RemoteDir:         config.RemoteDir,
-		Dir:               config.Dir,
-		FileName:          config.FileName,
-		Public:            config.Public,
-		Validation:        config.Validation,
-		CategoryItems:     config.CategoryItems,
-		ErrorHandler:      config.ErrorHandler,
-		Logger:            config.Logger,
-		Storage:           config.Storage,
+		StorageBucketName:   config.StorageBucketName,
+		RemoteDir:           config.RemoteDir,
+		Dir:                 config.Dir,
+		FileName:            config.FileName,
+		Public:              config.Public,
+		Validation:          config.Validation,
+		CategoryItems:       config.CategoryItems,
+		PublicUrlResolver:   config.PublicUrlResolver,
+		NoCacheBuster:       config.NoCacheBuster,
+		ReadOnly:            config.ReadOnly,
+		HttpDownloader:      config.HttpDownloader,
+		DownloadConcurrency: config.DownloadConcurrency,
+		UploadConcurrency:   config.UploadConcurrency,
+		RebaseAttempts:      config.RebaseAttempts,
+		PublishLock:         config.PublishLock,
+		CompactThreshold:    config.CompactThreshold,
+		CompactBuckets:      config.CompactBuckets,
+		StreamPatches:       config.StreamPatches,
+		KeyCategory:         config.KeyCategory,
+		Clock:               config.Clock,
+		RetainedVersions:    config.RetainedVersions,
+		ErrorHandler:        config.ErrorHandler,
+		Logger:              config.Logger,
+		Storage:             config.Storage,
+	}
+
+	if master.PublicUrlResolver == nil {
+		if config.PublicUrlTemplate != "" {
+			master.PublicUrlResolver = NewPublicUrlTemplate(config.PublicUrlTemplate)
+		} else {
+			master.PublicUrlResolver = NewStoragePublicUrlResolver(config.Storage)
+		}
+	}
+
+	if master.PublishLock == nil && config.PublishLockTtl != 0 {
+		master.PublishLock = NewStorageLock(
+			config.ErrorHandler,
+			config.Logger,
+			config.Storage,
+			config.StorageBucketName,
+			master.publishLockPath(),
+			"",
+			config.PublishLockTtl,
+		)
+	}
+
+	// a Storage without public URLs, such as LocalStorage, is read directly unless a URL is configured
+	_, hasPublicUrls := config.Storage.(PublicUrlStorage)
+	readsStorage := config.Storage != nil &&
+		!hasPublicUrls &&
+		config.PublicUrlResolver == nil &&
+		config.PublicUrlTemplate == ""
+	if master.HttpDownloader == nil && !readsStorage {
+		client := config.HttpClient
+		if client == nil {
+			client = &http.Client{Timeout: defaultHttpTimeout}
+		}
+		retries := config.HttpRetries
+		if retries == 0 {
+			retries = defaultHttpRetries
+		}
+		master.HttpDownloader = NewHttpDownloader(
+			client,
+			retries,
+			defaultHttpRetryDelay,
+			config.Logger,
+		)
 	}
 
 	return &master
@@ -80,36 +205,46 @@ func (m *Master) Init() error {
 }
 
 func (m *Master) Download() error {
-	if m.Public {
-		masterUrl := fmt.Sprintf(
-			"https://storage.googleapis.com/%s/%s/%s?%d",
-			m.StorageBucketName,
-			m.RemoteDir,
-			m.FileName,
-			time.Now().Unix(),
-		)
+	return m.DownloadContext(context.Background())
+}
+
+func (m *Master) DownloadContext(ctx context.Context) error {
+	if (m.Public || m.ReadOnly) && m.HttpDownloader != nil {
+		masterUrl := m.PublicUrlResolver(m.StorageBucketName, joinPath(m.RemoteDir, m.FileName))
+		if !m.NoCacheBuster {
+			masterUrl = withCacheBuster(masterUrl, time.Now().Unix())
+		}
 
 		m.Logger.DebugF("debug", "downloading master from: %s", masterUrl)
 
-		response, e := http.Get(masterUrl)
+		body, _, e := m.HttpDownloader.Download(ctx, masterUrl, false)
 		if e != nil {
-			if !strings.Contains(e.Error(), "404") {
+			if !errors.Is(e, ErrObjectNotExist) {
 				m.ErrorHandler.Error(e)
 				return e
 			}
+			m.Logger.DebugF("debug", "no remote master found at: %s", masterUrl)
 		} else {
-			defer response.Body.Close()
-			_, e = io.Copy(m.File, response.Body)
+			_, e = m.File.Write(body)
+			if e != nil {
+				m.ErrorHandler.Error(e)
+				return e
+			}
 		}
 	} else {
-		reader, e := m.Storage.GetDownloadReader(m.StorageBucketName, joinPath(m.RemoteDir, m.FileName))
+		reader, e := m.Storage.GetDownloadReader(ctx, m.StorageBucketName, joinPath(m.RemoteDir, m.FileName))
 		if e != nil {
-			if !strings.Contains(e.Error(), "object doesn't exist") {
+			if !errors.Is(e, ErrObjectNotExist) {
 				m.ErrorHandler.Error(e)
 				return e
 			}
 		} else {
-			_, e = io.Copy(m.File, reader)
+			defer reader.Close()
+			_, e = copyContext(ctx, m.File, reader)
+			if e != nil {
+				m.ErrorHandler.Error(e)
+				return e
+			}
 		}
 	}
 
@@ -119,23 +254,35 @@ func (m *Master) Download() error {
 		return e
 	}
 	reader := csv.NewReader(m.File)
+	reader.FieldsPerRecord = -1
+	lineNumber := 0
 	for true {
 		line, e := reader.Read()
 
 		if e == io.EOF {
 			break
 		}
+		lineNumber++
+		if e != nil {
+			return m.malformedRow(lineNumber, "unreadable csv", e)
+		}
 
 		if len(line) == 3 {
 			m.Logger.DebugF("debug", "found remote master, datetime: %s", line[2])
 			m.Version = line[0]
 			m.UnixTime, e = strconv.ParseInt(line[1], 10, 64)
+			if e != nil {
+				return m.malformedRow(lineNumber, "invalid unix time", e)
+			}
 			m.DateTime = line[2]
 			continue
 		}
 
 		if len(line) == 6 {
 			bucketNumber, e := strconv.Atoi(line[0])
+			if e != nil {
+				return m.malformedRow(lineNumber, "invalid bucket number", e)
+			}
 			if bucketNumber == -1 {
 				m.Categories = NewCategories(
 					m.ErrorHandler,
@@ -149,19 +296,22 @@ func (m *Master) Download() error {
 					line[4],
 					m.CategoryItems,
 				)
+				m.Categories.PublicUrlResolver = m.PublicUrlResolver
+				if m.ReadOnly {
+					m.Categories.HttpDownloader = m.HttpDownloader
+				}
 				e = m.Categories.Init()
 				if e != nil {
 					return e
 				}
-				e = m.Categories.Download()
+				e = m.Categories.DownloadContext(ctx)
 				if e != nil {
 					return e
 				}
 			} else {
 				lineCount, e := strconv.Atoi(line[5])
 				if e != nil {
-					m.ErrorHandler.Error(e)
-					return e
+					return m.malformedRow(lineNumber, "invalid patch count", e)
 				}
 				bucket := NewBucket(
 					m.ErrorHandler,
@@ -177,6 +327,11 @@ func (m *Master) Download() error {
 					lineCount,
 					m.Validation,
 				)
+				bucket.PublicUrlResolver = m.PublicUrlResolver
+				bucket.StreamPatches = m.StreamPatches
+				if m.ReadOnly {
+					bucket.HttpDownloader = m.HttpDownloader
+				}
 				m.Buckets = append(m.Buckets, bucket)
 				m.Logger.DebugF(
 					"debug",
@@ -194,9 +349,93 @@ func (m *Master) Download() error {
 	return nil
 }
 
+func (m *Master) Refresh() error {
+	return m.RefreshContext(context.Background())
+}
+
+// RefreshContext discards local changes and downloads the latest remote master and its buckets again. Buckets
+// which have not changed remotely are kept, and the next CompileList only replays what is new.
+func (m *Master) RefreshContext(ctx context.Context) error {
+	for _, bucket := range m.Buckets {
+		if bucket.File != nil {
+			bucket.File.Close()
+		}
+		if bucket.ZippedFile != nil {
+			bucket.ZippedFile.Close()
+		}
+		// changed buckets hold local patches, remove them so they are downloaded or created afresh
+		if bucket.IsChanged {
+			for _, fileName := range []string{bucket.FileName, bucket.ZippedFileName} {
+				e := os.Remove(filepath.Join(m.Dir, fileName))
+				if e != nil && !os.IsNotExist(e) {
+					m.ErrorHandler.Error(e)
+					return e
+				}
+			}
+		}
+	}
+	if m.Categories != nil {
+		m.Categories.File.Close()
+		m.Categories.ZippedFile.Close()
+	}
+	m.Buckets = nil
+	m.Categories = nil
+	m.PendingPatches = nil
+
+	e := m.File.Truncate(0)
+	if e != nil {
+		m.ErrorHandler.Error(e)
+		return e
+	}
+	_, e = m.File.Seek(0, io.SeekStart)
+	if e != nil {
+		m.ErrorHandler.Error(e)
+		return e
+	}
+
+	e = m.DownloadContext(ctx)
+	if e != nil {
+		return e
+	}
+
+	return m.DownloadBucketsContext(ctx)
+}
+
+func (m *Master) now() time.Time {
+	if m.Clock == nil {
+		return time.Now()
+	}
+
+	return m.Clock()
+}
+
+func (m *Master) keyCategory() func(key string) string {
+	if m.KeyCategory == nil {
+		return DefaultKeyCategory
+	}
+
+	return m.KeyCategory
+}
+
+func (m *Master) malformedRow(lineNumber int, reason string, e error) error {
+	e = &MalformedRowError{
+		Path:   joinPath(m.RemoteDir, m.FileName),
+		Line:   lineNumber,
+		Reason: reason,
+		Err:    e,
+	}
+	m.ErrorHandler.Error(e)
+	return e
+}
+
 func (m *Master) DownloadBuckets() error {
+	return m.DownloadBucketsContext(context.Background())
+}
+
+func (m *Master) DownloadBucketsContext(ctx context.Context) error {
 	m.Logger.DebugF("debug", "downloading buckets")
-	for _, bucket := range m.Buckets {
+	return runParallel(ctx, len(m.Buckets), m.DownloadConcurrency, func(ctx context.Context, i int) error {
+		bucket := m.Buckets[i]
 		e := bucket.Init()
 		if e != nil {
 			m.ErrorHandler.Error(e)
@@ -204,95 +443,331 @@ func (m *Master) DownloadBuckets() error {
 		}
 		e = bucket.VerifyUnzipped()
 		if e != nil {
-			e = bucket.Download()
+			e = bucket.DownloadContext(ctx)
 			if e != nil {
 				m.ErrorHandler.Error(e)
 				return e
 			}
 		}
-	}
 
-	return nil
+		return nil
+	})
 }
 
+// CompileList replays the patches of every bucket which is not deleted, leaving out keys which have expired
+// according to Clock. The result is kept along with the buckets it was built from, so the next call only replays
+// new buckets and patches appended to the last one, unless an earlier bucket changed.
 func (m *Master) CompileList() (map[string][]string, error) {
+	return m.CompileListAsOf(m.now())
+}
+
+// CompileListAsOf is CompileList leaving out the keys which have expired by the given time
+func (m *Master) CompileListAsOf(now time.Time) (map[string][]string, error) {
+	state, e := m.compileState()
+	if e != nil {
+		return nil, e
+	}
+
+	return state.listAsOf(now), nil
+}
+
+// compileState brings the kept compiled state up to date with the buckets
+func (m *Master) compileState() (*listState, error) {
 	m.Logger.DebugF("debug", "compiling bucket list")
+	var buckets []*Bucket
+	for _, bucket := range m.Buckets {
+		if !bucket.IsDeleted {
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	state, start, startPatch, e := m.compiled.resume(buckets)
+	if e != nil {
+		m.ErrorHandler.Error(e)
+		return nil, e
+	}
+	if state == nil {
+		state = newListState()
+	} else {
+		m.Logger.DebugF("debug", "resuming compiled list from bucket %d patch %d", start, startPatch)
+	}
+	// the kept state is replayed onto in place, so it is only kept again once the replay succeeds
+	m.compiled = nil
+
 	totalPatches := 0
-	list := make(map[string][]string)
+	for i, bucket := range buckets[start:] {
+		from := 0
+		if i == 0 {
+			from = startPatch
+		}
+		e = bucket.Replay(from, func(index int, patch Patch) error {
+			totalPatches++
+			state.apply(patch, m.keyCategory())
+
+			return nil
+		})
+		if e != nil {
+			m.ErrorHandler.Error(e)
+			return nil, e
+		}
+	}
+
+	m.compiled, e = newCompiledList(state, buckets)
+	if e != nil {
+		m.ErrorHandler.Error(e)
+		return nil, e
+	}
+
+	m.Logger.InfoF("LIST", "Total patches: %d, total compiled length: %d", totalPatches, len(state.Values))
+
+	return state, nil
+}
+
+// Replay calls fn with every patch of the buckets which are not deleted, in the order CompileList applies them
+func (m *Master) Replay(fn func(patch Patch) error) error {
 	for _, bucket := range m.Buckets {
 		if bucket.IsDeleted {
 			continue
 		}
-		totalPatches += len(bucket.Patches)
-		for _, patch := range bucket.Patches {
-			switch patch.GetAction() {
-			case "+":
-				list[patch.GetKey()] = patch.GetValues()
-				break
-			case "-":
-				delete(list, patch.GetKey())
-				break
-			case "*":
-				list = make(map[string][]string)
-				break
-			}
+		e := bucket.Replay(0, func(index int, patch Patch) error {
+			return fn(patch)
+		})
+		if e != nil {
+			return e
 		}
 	}
 
-	m.Logger.InfoF("LIST", "Total patches: %d, total compiled length: %d", totalPatches, len(list))
+	return nil
+}
+
+// WastageReport describes how much of the patch log no longer contributes to the compiled list. A patch is dead
+// once its key is set again, removed or cleared, remove and clear patches are always dead. Patches which modify
+// the values of a key live and die along with the patch which set it, all of them are dead once it expires
+// according to Clock.
+type WastageReport struct {
+	LiveKeys     int
+	TotalPatches int
+	DeadPatches  int
+	Percent      int
+	BytesWasted  int64
+	Buckets      []*BucketWastage
+}
+
+// BucketWastage is the share of a WastageReport belonging to one bucket. Bytes are the length of its patches as
+// csv rows before compression.
+type BucketWastage struct {
+	Number      int
+	Patches     int
+	LivePatches int
+	DeadPatches int
+	Bytes       int64
+	LiveBytes   int64
+	BytesWasted int64
+	// numbers of the buckets which must be merged whenever this one is, as its patches hide or extend theirs
+	requires map[int]bool
+}
+
+// LiveRatio returns the fraction of the bucket's bytes which are still live, 1 for an empty bucket
+func (b *BucketWastage) LiveRatio() float64 {
+	if b.Bytes == 0 {
+		return 1
+	}
+
+	return float64(b.LiveBytes) / float64(b.Bytes)
+}
+
+// liveKey is the chain of patches producing the current values of a key, the patch which set it followed by
+// those which modified it, along with the buckets of the chain it replaced
+type liveKey struct {
+	patches    []livePatch
+	superseded []*BucketWastage
+	expires    time.Time
+}
 
-	return list, nil
+type livePatch struct {
+	bucket *BucketWastage
+	index  int
+	size   int64
 }
 
-type change struct {
-	key       string
-	bucketKey int
-	patchKey  int
+// CalculateWastage replays the patches of every bucket which is not deleted as CompileList does
+func (m *Master) CalculateWastage() (*WastageReport, error) {
+	report, _, e := m.replayWastage()
+	return report, e
 }
 
-func (m *Master) CalculateWastage() (int, error) {
+// replayWastage returns the WastageReport and the chain of patches producing each key in the compiled list
+func (m *Master) replayWastage() (*WastageReport, map[string]*liveKey, error) {
 	m.Logger.DebugF("debug", "Calculating wastage")
-	changes := make(map[string][]change)
-	for bucketKey, bucket := range m.Buckets {
-		for patchKey, patch := range bucket.Patches {
-			if _, ok := changes[patch.GetKey()]; !ok {
-				changes[patch.GetKey()] = []change{{
-					key:       patch.GetKey(),
-					bucketKey: bucketKey,
-					patchKey:  patchKey,
-				}}
-			} else {
-				changes[patch.GetKey()] = append(changes[patch.GetKey()], change{
-					key:       patch.GetKey(),
-					bucketKey: bucketKey,
-					patchKey:  patchKey,
-				})
+	report := &WastageReport{}
+	live := make(map[string]*liveKey)
+	require := func(bucket *BucketWastage, required *BucketWastage) {
+		if bucket != required {
+			bucket.requires[required.Number] = true
+		}
+	}
+	killPatch := func(patch livePatch) {
+		patch.bucket.DeadPatches++
+		patch.bucket.BytesWasted += patch.size
+	}
+	clears := func(patch Patch, key string) bool {
+		if Action(patch.GetAction()) == ActionClearCategory {
+			return m.keyCategory()(key) == patch.GetKey()
+		}
+		return strings.HasPrefix(key, patch.GetKey())
+	}
+	// killKey kills the chain of a key hidden by a patch of the given bucket
+	killKey := func(key *liveKey, by *BucketWastage) {
+		for _, patch := range key.patches {
+			killPatch(patch)
+			for _, superseded := range key.superseded {
+				require(patch.bucket, superseded)
+			}
+			if by != nil {
+				require(by, patch.bucket)
 			}
 		}
 	}
 
-	var wastage []change
+	for _, bucket := range m.Buckets {
+		if bucket.IsDeleted {
+			continue
+		}
+		bucketWastage := &BucketWastage{
+			Number:   bucket.Number,
+			Patches:  bucket.PatchCount,
+			requires: make(map[int]bool),
+		}
+		report.Buckets = append(report.Buckets, bucketWastage)
 
-	for _, history := range changes {
-		if len(history) > 1 {
-			if len(history)%2 == 0 {
-				// no longer in list
-				wastage = append(wastage, history...)
-			} else {
-				// in list
-				wastage = append(wastage, history[:len(history)-1]...)
+		e := bucket.Replay(0, func(index int, patch Patch) error {
+			size, e := patchSize(patch)
+			if e != nil {
+				return e
+			}
+			bucketWastage.Bytes += size
+			current := livePatch{
+				bucket: bucketWastage,
+				index:  index,
+				size:   size,
+			}
+			existing, exists := live[patch.GetKey()]
+
+			switch Action(patch.GetAction()) {
+			case ActionAdd:
+				key := &liveKey{
+					patches: []livePatch{current},
+					expires: patchExpires(patch),
+				}
+				if exists {
+					// the new chain hides the old one once the old one is dead
+					killKey(existing, nil)
+					for _, previous := range existing.patches {
+						key.superseded = append(key.superseded, previous.bucket)
+					}
+				}
+				live[patch.GetKey()] = key
+			case ActionAppend, ActionSetField, ActionRemoveValues:
+				if !exists {
+					if Action(patch.GetAction()) == ActionRemoveValues {
+						killPatch(current)
+						break
+					}
+					live[patch.GetKey()] = &liveKey{patches: []livePatch{current}}
+					break
+				}
+				// earlier patches of the chain cannot be moved after this one
+				for _, previous := range existing.patches {
+					require(previous.bucket, bucketWastage)
+				}
+				existing.patches = append(existing.patches, current)
+			case ActionRemove:
+				if exists {
+					killKey(existing, bucketWastage)
+					delete(live, patch.GetKey())
+				}
+				killPatch(current)
+			case ActionClear:
+				for _, existing := range live {
+					killKey(existing, bucketWastage)
+				}
+				live = make(map[string]*liveKey)
+				killPatch(current)
+			case ActionClearPrefix, ActionClearCategory:
+				for key, existing := range live {
+					if clears(patch, key) {
+						killKey(existing, bucketWastage)
+						delete(live, key)
+					}
+				}
+				killPatch(current)
+			default:
+				killPatch(current)
 			}
+
+			return nil
+		})
+		if e != nil {
+			m.ErrorHandler.Error(e)
+			return nil, nil, e
+		}
+	}
+
+	// expired keys are dead, along with every patch hidden by them
+	now := m.now()
+	for key, existing := range live {
+		if !existing.expires.IsZero() && !existing.expires.After(now) {
+			killKey(existing, nil)
+			delete(live, key)
 		}
 	}
 
-	wastePercent := int((float64(len(wastage)) / float64(len(changes))) * 100)
+	for _, bucketWastage := range report.Buckets {
+		bucketWastage.LivePatches = bucketWastage.Patches - bucketWastage.DeadPatches
+		bucketWastage.LiveBytes = bucketWastage.Bytes - bucketWastage.BytesWasted
+		report.TotalPatches += bucketWastage.Patches
+		report.DeadPatches += bucketWastage.DeadPatches
+		report.BytesWasted += bucketWastage.BytesWasted
+	}
+	report.LiveKeys = len(live)
+	if report.TotalPatches > 0 {
+		report.Percent = report.DeadPatches * 100 / report.TotalPatches
+	}
 
-	m.Logger.DebugF("debug", "%d items wasted %d%%", len(wastage), wastePercent)
+	m.Logger.DebugF("debug", "%d items wasted %d%%", report.DeadPatches, report.Percent)
 
-	return wastePercent, nil
+	return report, live, nil
+}
+
+// patchSize returns the length of the patch as a bucket csv row
+func patchSize(patch Patch) (int64, error) {
+	var buffer bytes.Buffer
+	patchWriter := csv.NewWriter(&buffer)
+	e := patchWriter.Write(patchRow(patch))
+	if e != nil {
+		return 0, e
+	}
+	patchWriter.Flush()
+
+	return int64(buffer.Len()), patchWriter.Error()
 }
 
 func (m *Master) AddPatch(patch Patch) error {
+	if m.ReadOnly {
+		return ErrReadOnly
+	}
+
+	e := m.addPatch(patch)
+	if e != nil {
+		return e
+	}
+	m.PendingPatches = append(m.PendingPatches, patch)
+
+	return nil
+}
+
+// addPatch appends the patch to the latest bucket, starting a new bucket when it is full or deleted
+func (m *Master) addPatch(patch Patch) error {
 	maxBucketNumber := 0
 	var latestBucket *Bucket
 	for _, bucket := range m.Buckets {
@@ -312,31 +787,42 @@ func (m *Master) AddPatch(patch Patch) error {
 		}
 	}
 
-	if latestBucket == nil || full {
-		latestBucket = NewBucket(
-			m.ErrorHandler,
-			m.Logger,
-			m.Storage,
-			m.StorageBucketName,
-			"",
-			"",
-			m.Dir,
-			maxBucketNumber+1,
-			"",
-			"",
-			0,
-			m.Validation,
-		)
-		e := latestBucket.Init()
+	if latestBucket == nil || latestBucket.IsDeleted || full {
+		latestBucket, e = m.newBucket(maxBucketNumber + 1)
 		if e != nil {
 			return e
 		}
-		m.Buckets = append(m.Buckets, latestBucket)
 	}
 
 	return latestBucket.AddPatch(patch)
 }
 
+func (m *Master) newBucket(number int) (*Bucket, error) {
+	bucket := NewBucket(
+		m.ErrorHandler,
+		m.Logger,
+		m.Storage,
+		m.StorageBucketName,
+		"",
+		"",
+		m.Dir,
+		number,
+		"",
+		"",
+		0,
+		m.Validation,
+	)
+	bucket.PublicUrlResolver = m.PublicUrlResolver
+	bucket.StreamPatches = m.StreamPatches
+	e := bucket.Init()
+	if e != nil {
+		return nil, e
+	}
+	m.Buckets = append(m.Buckets, bucket)
+
+	return bucket, nil
+}
+
 func (m *Master) InitCategories() error {
 	if m.Categories == nil {
 		m.Categories = NewCategories(
@@ -351,6 +837,7 @@ func (m *Master) InitCategories() error {
 			"",
 			m.CategoryItems,
 		)
+		m.Categories.PublicUrlResolver = m.PublicUrlResolver
 		e := m.Categories.Init()
 		if e != nil {
 			return e
@@ -361,201 +848,308 @@ func (m *Master) InitCategories() error {
 }
 
 func (m *Master) UploadToStorageBucket() error {
-	m.Logger.DebugF("debug", "uploading to storage bucket")
-	now := time.Now()
-	m.UnixTime = now.Unix()
-	m.DateTime = now.Format(cbutil.DateTimeFormat)
+	return m.UploadToStorageBucketContext(context.Background())
+}
 
-	e := m.File.Truncate(0)
+// UploadToStorageBucketContext publishes the master in two phases. Changed buckets and categories are first staged
+// under new remote names and verified, then the master is written last, provided the remote master has not changed
+// since it was downloaded. Progress is journalled in Dir, see RecoverPublishContext. A ConflictError is returned
+// when another publisher wrote the master first and RebaseAttempts have been exhausted.
+func (m *Master) UploadToStorageBucketContext(ctx context.Context) error {
+	if m.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return m.publishWithRebase(ctx, m.compactIfWasteful)
+}
+
+// publishWithRebase publishes, rebasing and retrying up to RebaseAttempts times when another publisher wins.
+// compact is run before every attempt, so it applies to the rebased buckets too.
+func (m *Master) publishWithRebase(ctx context.Context, compact func() error) error {
+	for attempt := 0; true; attempt++ {
+		e := compact()
+		if e != nil {
+			return e
+		}
+
+		e = m.publish(ctx)
+		if !errors.Is(e, ErrConflict) || attempt >= m.RebaseAttempts {
+			return e
+		}
+
+		m.Logger.InfoF("debug", "remote master changed, rebasing %d pending patches", len(m.PendingPatches))
+		e = m.RebaseContext(ctx)
+		if e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+func (m *Master) publish(ctx context.Context) error {
+	e := m.checkPublishLock()
 	if e != nil {
-		m.ErrorHandler.Error(e)
 		return e
 	}
-	_, e = m.File.Seek(0, io.SeekStart)
+
+	journal, e := m.readJournal()
 	if e != nil {
 		m.ErrorHandler.Error(e)
 		return e
 	}
+	if journal != nil {
+		return ErrInterruptedPublish
+	}
 
-	masterCsv := csv.NewWriter(m.File)
-	e = masterCsv.Write([]string{
-		"V1",
-		strconv.FormatInt(m.UnixTime, 10),
-		m.DateTime,
-	})
+	m.Precondition, e = m.publishPrecondition(ctx)
 	if e != nil {
-		m.ErrorHandler.Error(e)
 		return e
 	}
-	masterCsv.Flush()
-	e = masterCsv.Error()
+
+	m.Logger.DebugF("debug", "uploading to storage bucket")
+	now := time.Now()
+	unixTime := now.Unix()
+	publishId, e := newPublishId(unixTime)
 	if e != nil {
 		m.ErrorHandler.Error(e)
 		return e
 	}
 
+	var liveBuckets []*Bucket
+	var changedBuckets []*Bucket
+	for _, bucket := range m.Buckets {
+		if bucket.IsDeleted {
+			continue
+		}
+		liveBuckets = append(liveBuckets, bucket)
+		if bucket.IsChanged {
+			changedBuckets = append(changedBuckets, bucket)
+		}
+	}
+	sort.Slice(liveBuckets, func(i, j int) bool {
+		return liveBuckets[i].Number < liveBuckets[j].Number
+	})
+
+	categoriesChanged := false
 	if m.Categories != nil {
 		e = m.Categories.Write()
 		if e != nil {
 			return e
 		}
 
-		categoriesChanged, e := m.Categories.IsChanged()
+		categoriesChanged, e = m.Categories.IsChanged()
 		if e != nil {
 			return e
 		}
-		if categoriesChanged {
-			e = m.Categories.Compress()
-			if e != nil {
-				return e
-			}
-			e = m.Categories.Hash()
-			if e != nil {
-				return e
-			}
-			m.Categories.RelativeFilePath = strconv.FormatInt(m.UnixTime, 10) + "-" + m.Categories.ZippedFileName
-			m.Categories.RemoteFilePath = joinPath(
-				m.RemoteDir,
-				m.Categories.RelativeFilePath,
-			)
+	}
 
-			e = m.Categories.Upload(m.Public)
-			if e != nil {
-				return e
-			}
-		}
+	// journal the objects about to be staged so they can be rolled back if the publish is interrupted
+	journal = &publishJournal{
+		Phase:        journalPhaseStaging,
+		Precondition: m.Precondition,
+		Staged:       make(map[string]string),
+	}
+	if categoriesChanged {
+		journal.Staged[joinPath(m.RemoteDir, stagedFileName(publishId, m.Categories.ZippedFileName))] = ""
+	}
+	for _, bucket := range changedBuckets {
+		journal.Staged[joinPath(m.RemoteDir, stagedFileName(publishId, bucket.ZippedFileName))] = ""
+	}
+	if m.RetainedVersions > 0 {
+		journal.Staged[m.versionPath(publishId)] = ""
+	}
+	e = m.writeJournal(journal)
+	if e != nil {
+		m.ErrorHandler.Error(e)
+		return e
+	}
 
-		e = masterCsv.Write([]string{
-			"-1",
-			m.Categories.RelativeFilePath,
-			"zlib",
-			m.Categories.ZippedHash,
-			m.Categories.UnzippedHash,
-			strconv.Itoa(len(m.CategoryItems)),
-		})
+	if categoriesChanged {
+		e = m.Categories.Compress()
 		if e != nil {
-			m.ErrorHandler.Error(e)
 			return e
 		}
-		masterCsv.Flush()
-		e = masterCsv.Error()
+		e = m.Categories.Hash()
 		if e != nil {
-			m.ErrorHandler.Error(e)
 			return e
 		}
-	}
+		m.Categories.RelativeFilePath = stagedFileName(publishId, m.Categories.ZippedFileName)
+		m.Categories.RemoteFilePath = joinPath(
+			m.RemoteDir,
+			m.Categories.RelativeFilePath,
+		)
 
-	for _, bucket := range m.Buckets {
-		if bucket.IsDeleted {
-			continue
+		e = m.Categories.UploadContext(ctx, m.Public)
+		if e != nil {
+			return e
 		}
-		if bucket.IsChanged {
-			m.Logger.DebugF("debug", "bucket has changed, compressing and hashing: %s", bucket.FileName)
-			e := bucket.Compress()
-			if e != nil {
-				return e
-			}
-			e = bucket.VerifyZipped()
-			if e != nil {
-				return e
-			}
-			e = bucket.Hash()
-			if e != nil {
-				return e
-			}
+		journal.Staged[m.Categories.RemoteFilePath] = m.Categories.ZippedHash
+	}
 
-			bucket.RelativeFilePath = strconv.FormatInt(m.UnixTime, 10) + "-" + bucket.ZippedFileName
-			bucket.RemoteFilePath = joinPath(
-				m.RemoteDir,
-				bucket.RelativeFilePath,
-			)
-			e = bucket.Upload(m.Public)
-			if e != nil {
-				return e
-			}
-		}
+	e = runParallel(ctx, len(changedBuckets), m.UploadConcurrency, func(ctx context.Context, i int) error {
+		return m.uploadBucket(ctx, changedBuckets[i], publishId)
+	})
+	if e != nil {
+		return e
+	}
+	for _, bucket := range changedBuckets {
+		journal.Staged[bucket.RemoteFilePath] = bucket.ZippedHash
+	}
 
-		e = masterCsv.Write([]string{
+	rows := [][]string{{
+		"V1",
+		strconv.FormatInt(unixTime, 10),
+		now.Format(cbutil.DateTimeFormat),
+	}}
+	if m.Categories != nil {
+		rows = append(rows, []string{
+			"-1",
+			m.Categories.RelativeFilePath,
+			"zlib",
+			m.Categories.ZippedHash,
+			m.Categories.UnzippedHash,
+			strconv.Itoa(len(m.CategoryItems)),
+		})
+	}
+	for _, bucket := range liveBuckets {
+		rows = append(rows, []string{
 			strconv.Itoa(bucket.Number),
 			bucket.RelativeFilePath,
 			"zlib",
 			bucket.ZippedHash,
 			bucket.UnzippedHash,
-			strconv.Itoa(len(bucket.Patches)),
+			strconv.Itoa(bucket.PatchCount),
 		})
+	}
+
+	e = m.finishPublish(ctx, journal, publishId, rows)
+	if e != nil {
+		return e
+	}
+
+	m.UnixTime = unixTime
+	m.DateTime = now.Format(cbutil.DateTimeFormat)
+
+	return nil
+}
+
+// finishPublish writes the versioned master when RetainedVersions is set, verifies every staged object and then
+// commits the master rows, rolling the staged objects back if the master cannot be written
+func (m *Master) finishPublish(ctx context.Context, journal *publishJournal, publishId string, rows [][]string) error {
+	var e error
+	if m.RetainedVersions > 0 {
+		versionPath := m.versionPath(publishId)
+		journal.Staged[versionPath], e = m.uploadVersion(ctx, versionPath, rows)
 		if e != nil {
 			m.ErrorHandler.Error(e)
 			return e
 		}
-		masterCsv.Flush()
-		e = masterCsv.Error()
-		if e != nil {
-			m.ErrorHandler.Error(e)
-			return e
-		}
-
 	}
 
-	_, e = m.File.Seek(0, io.SeekStart)
+	e = m.verifyStaged(ctx, journal)
 	if e != nil {
 		m.ErrorHandler.Error(e)
 		return e
 	}
 
-	m.Logger.InfoF("debug", "uploading: %s", joinPath(m.RemoteDir, m.FileName))
-
-	storageWriter, e := m.Storage.GetUploadWriter(
-		m.StorageBucketName,
-		joinPath(m.RemoteDir, m.FileName),
-	)
+	journal.Phase = journalPhaseVerified
+	journal.Rows = rows
+	e = m.writeJournal(journal)
 	if e != nil {
 		m.ErrorHandler.Error(e)
 		return e
 	}
 
-	_, e = io.Copy(storageWriter, m.File)
+	// the lock may have been lost while staging, leave the master to its new holder
+	e = m.checkPublishLock()
 	if e != nil {
+		rollbackE := m.rollbackPublish(ctx, journal)
+		if rollbackE != nil {
+			return rollbackE
+		}
+		return e
+	}
+
+	e = m.commitPublish(ctx, journal)
+	if errors.Is(e, ErrConflict) {
 		m.ErrorHandler.Error(e)
+		rollbackE := m.rollbackPublish(ctx, journal)
+		if rollbackE != nil {
+			return rollbackE
+		}
 		return e
 	}
-	e = storageWriter.Close()
 	if e != nil {
 		m.ErrorHandler.Error(e)
 		return e
 	}
 
-	if m.Public {
-		e = m.Storage.MakePublic(
-			m.StorageBucketName,
-			joinPath(m.RemoteDir, m.FileName),
-		)
-		if e != nil {
-			m.ErrorHandler.Error(e)
-			return e
-		}
+	return nil
+}
+
+// uploadBucket compresses, verifies, hashes and uploads a changed bucket under a new remote file name
+func (m *Master) uploadBucket(ctx context.Context, bucket *Bucket, publishId string) error {
+	m.Logger.DebugF("debug", "bucket has changed, compressing and hashing: %s", bucket.FileName)
+	e := bucket.Compress()
+	if e != nil {
+		return e
+	}
+	e = bucket.VerifyZipped()
+	if e != nil {
+		return e
+	}
+	e = bucket.Hash()
+	if e != nil {
+		return e
 	}
 
-	return nil
+	bucket.RelativeFilePath = stagedFileName(publishId, bucket.ZippedFileName)
+	bucket.RemoteFilePath = joinPath(
+		m.RemoteDir,
+		bucket.RelativeFilePath,
+	)
+
+	return bucket.UploadContext(ctx, m.Public)
 }
 
 func (m *Master) CleanupOldFiles() error {
-	files, e := m.Storage.Ls(m.StorageBucketName, m.RemoteDir)
+	return m.CleanupOldFilesContext(context.Background())
+}
+
+// CleanupOldFilesContext deletes remote files which have been unreferenced for more than 24 hours. Files are
+// referenced by the master, or by one of the RetainedVersions most recent versioned masters.
+func (m *Master) CleanupOldFilesContext(ctx context.Context) error {
+	if m.ReadOnly {
+		return ErrReadOnly
+	}
+	e := m.checkPublishLock()
+	if e != nil {
+		return e
+	}
+
+	retained, e := m.retainedFiles(ctx)
+	if e != nil {
+		return e
+	}
+
+	files, e := m.Storage.Ls(ctx, m.StorageBucketName, m.RemoteDir)
 	if e != nil {
 		m.ErrorHandler.Error(e)
 		return e
 	}
 
 	for _, file := range files {
-		found := false
+		found := retained[file.Name]
 		if m.Categories != nil && file.Name == m.Categories.RemoteFilePath {
 			found = true
 		}
 		for _, bucket := range m.Buckets {
-			if file.Name == bucket.RemoteFilePath {
+			if !bucket.IsDeleted && file.Name == bucket.RemoteFilePath {
 				found = true
 			}
 		}
-		if file.Name == m.RemoteDir+"/"+m.FileName {
+		if file.Name == m.RemoteDir+"/"+m.FileName || file.Name == m.publishLockPath() {
 			found = true
 		}
 		if !found {
@@ -564,7 +1158,7 @@ func (m *Master) CleanupOldFiles() error {
 			if file.Created.Before(time.Now().Add(-time.Hour * 24)) {
 				m.Logger.DebugF("debug", "File is more than 24 hours old, deleting now: %s", file.Name)
 
-				e = m.Storage.Delete(m.StorageBucketName, file.Name)
+				e = m.Storage.Delete(ctx, m.StorageBucketName, file.Name)
 				if e != nil {
 					m.ErrorHandler.Error(e)
 					return e
@@ -593,7 +1187,7 @@ func (m *Master) CleanupOldLocalFiles() error {
 				found = true
 			}
 		}
-		if file == m.Dir+"/"+m.FileName {
+		if file == m.Dir+"/"+m.FileName || filepath.Clean(file) == m.journalPath() {
 			found = true
 		}
 		if !found {
@@ -625,6 +1219,22 @@ func (m *Master) Close() {
 	}
 }
 
+// newPublishId returns a prefix unique to one publish, starting with the unix time it was published at
+func newPublishId(unixTime int64) (string, error) {
+	nonce := make([]byte, 4)
+	_, e := rand.Read(nonce)
+	if e != nil {
+		return "", e
+	}
+
+	return strconv.FormatInt(unixTime, 10) + "-" + hex.EncodeToString(nonce), nil
+}
+
+// stagedFileName returns the unique relative path an object is uploaded to by a publish
+func stagedFileName(publishId string, fileName string) string {
+	return publishId + "-" + fileName
+}
+
 func joinPath(parts ...string) string {
 	return strings.Join(parts, "/")
 }
@@ -0,0 +1,352 @@
+package cbpatch
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type testErrorHandler struct{}
+
+func (t testErrorHandler) Error(e error) {}
+
+type testLogger struct{}
+
+func (t testLogger) InfoF(category string, message string, args ...interface{}) {}
+
+func (t testLogger) DebugF(category string, message string, args ...interface{}) {}
+
+type testCategoriesItem struct {
+	id       int
+	category string
+}
+
+func (t testCategoriesItem) GetId() int {
+	return t.id
+}
+
+func (t testCategoriesItem) GetCategory() string {
+	return t.category
+}
+
+func (t testCategoriesItem) GetSubcategory() string {
+	return ""
+}
+
+func (t testCategoriesItem) GetIdentifier() string {
+	return strconv.Itoa(t.id)
+}
+
+func (t testCategoriesItem) GetDescription() string {
+	return t.category
+}
+
+func (t testCategoriesItem) GetTlc() string {
+	return ""
+}
+
+func (t testCategoriesItem) GetSlc() string {
+	return ""
+}
+
+func newTestDir(t *testing.T) string {
+	t.Helper()
+	dir, e := ioutil.TempDir("", "cbpatch")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	return dir
+}
+
+// testConfig configures a master stored in the given storage, with every row valid
+func testConfig(storage Storage, dir string) Config {
+	return Config{
+		StorageBucketName: "bucket",
+		RemoteDir:         "lists",
+		Dir:               dir,
+		FileName:          "master.csv",
+		Validation: func(line []string, bucket *Bucket) error {
+			return nil
+		},
+		ErrorHandler: testErrorHandler{},
+		Logger:       testLogger{},
+		Storage:      storage,
+	}
+}
+
+// newTestMaster creates and downloads a master stored in the given storage, without downloading its buckets
+func newTestMaster(t *testing.T, storage Storage, dir string, configure func(config *Config)) *Master {
+	t.Helper()
+	e := os.MkdirAll(dir, os.ModePerm)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	config := testConfig(storage, dir)
+	if configure != nil {
+		configure(&config)
+	}
+	m := NewMaster(config)
+	e = m.Init()
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = m.Download()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	return m
+}
+
+// downloadTestMaster is newTestMaster which also downloads the buckets
+func downloadTestMaster(t *testing.T, storage Storage, dir string, configure func(config *Config)) *Master {
+	t.Helper()
+	m := newTestMaster(t, storage, dir, configure)
+	e := m.DownloadBuckets()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	return m
+}
+
+func compileTestList(t *testing.T, m *Master) map[string][]string {
+	t.Helper()
+	list, e := m.CompileList()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	return list
+}
+
+func addTestPatch(t *testing.T, m *Master, action Action, key string, values ...string) {
+	t.Helper()
+	e := m.AddPatch(&DefaultPatch{Action: string(action), Key: key, Values: values})
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+func publishTestMaster(t *testing.T, m *Master) {
+	t.Helper()
+	e := m.UploadToStorageBucket()
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestMaster_DownloadBuckets_ChecksumMismatch(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+
+	publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), nil)
+	addTestPatch(t, publisher, ActionAdd, "key", "value")
+	publishTestMaster(t, publisher)
+
+	storage.InjectFault(&MemoryFault{Method: MemoryMethodDownloadWriter, Name: ".csv.zlib", Truncate: 5})
+	consumer := newTestMaster(t, storage, filepath.Join(dir, "consumer"), nil)
+	e := consumer.DownloadBuckets()
+
+	var mismatch *ChecksumMismatchError
+	if !errors.As(e, &mismatch) {
+		t.Fatalf("expected a ChecksumMismatchError, got %v", e)
+	}
+	if !mismatch.Zipped {
+		t.Errorf("expected the zipped checksum to mismatch")
+	}
+	if errors.Is(e, ErrNotFound) {
+		t.Errorf("a corrupt bucket must not be reported as missing")
+	}
+}
+
+func TestMaster_DownloadBuckets_Missing(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+
+	publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), nil)
+	addTestPatch(t, publisher, ActionAdd, "key", "value")
+	publishTestMaster(t, publisher)
+
+	storage.InjectFault(&MemoryFault{Method: MemoryMethodDownloadWriter, Name: ".csv.zlib", Missing: true})
+	consumer := newTestMaster(t, storage, filepath.Join(dir, "consumer"), nil)
+	e := consumer.DownloadBuckets()
+
+	if !errors.Is(e, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", e)
+	}
+	if errors.Is(e, ErrChecksumMismatch) {
+		t.Errorf("a missing bucket must not be reported as a checksum mismatch")
+	}
+}
+
+func TestMaster_DownloadBuckets_Validation(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+
+	publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), nil)
+	addTestPatch(t, publisher, ActionAdd, "key", "value")
+	publishTestMaster(t, publisher)
+
+	invalid := errors.New("invalid key")
+	consumer := newTestMaster(t, storage, filepath.Join(dir, "consumer"), func(config *Config) {
+		config.Validation = func(line []string, bucket *Bucket) error {
+			return invalid
+		}
+	})
+	e := consumer.DownloadBuckets()
+
+	var validationError *ValidationError
+	if !errors.As(e, &validationError) || validationError.Line != 1 {
+		t.Fatalf("expected a ValidationError on line 1, got %v", e)
+	}
+	if !errors.Is(e, invalid) || !errors.Is(e, ErrValidation) {
+		t.Errorf("expected the error to match the validation error and ErrValidation, got %v", e)
+	}
+}
+
+func TestMaster_Download_MalformedRow(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+	storage.Put("bucket", "lists/master.csv", []byte("V1,1600000000,2020-09-13 12:26:40\nx,1.csv.zlib,zlib,a,b,1\n"))
+
+	consumer := NewMaster(testConfig(storage, dir))
+	e := consumer.Init()
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = consumer.Download()
+
+	var malformed *MalformedRowError
+	if !errors.As(e, &malformed) || malformed.Line != 2 || malformed.Path != "lists/master.csv" {
+		t.Fatalf("expected a MalformedRowError on line 2 of lists/master.csv, got %v", e)
+	}
+	if !errors.Is(e, ErrMalformedRow) {
+		t.Errorf("expected the error to match ErrMalformedRow, got %v", e)
+	}
+}
+
+func TestMaster_UploadToStorageBucket_Conflict(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+
+	first := downloadTestMaster(t, storage, filepath.Join(dir, "first"), nil)
+	second := downloadTestMaster(t, storage, filepath.Join(dir, "second"), nil)
+	addTestPatch(t, first, ActionAdd, "first", "1")
+	publishTestMaster(t, first)
+
+	addTestPatch(t, second, ActionAdd, "second", "2")
+	e := second.UploadToStorageBucket()
+	var conflict *ConflictError
+	if !errors.As(e, &conflict) {
+		t.Fatalf("expected a ConflictError, got %v", e)
+	}
+
+	// the objects staged by the losing publish are rolled back
+	files, e := storage.Ls(context.Background(), "bucket", "lists")
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, file := range files {
+		referenced := file.Name == "lists/master.csv"
+		for _, bucket := range first.Buckets {
+			referenced = referenced || file.Name == bucket.RemoteFilePath
+		}
+		if !referenced {
+			t.Errorf("staged object was not rolled back: %s", file.Name)
+		}
+	}
+
+	consumer := downloadTestMaster(t, storage, filepath.Join(dir, "consumer"), nil)
+	expected := map[string][]string{"first": {"1"}}
+	if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+}
+
+func TestMaster_UploadToStorageBucket_Rebase(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+	rebase := func(config *Config) {
+		config.RebaseAttempts = 1
+	}
+
+	first := downloadTestMaster(t, storage, filepath.Join(dir, "first"), rebase)
+	second := downloadTestMaster(t, storage, filepath.Join(dir, "second"), rebase)
+	addTestPatch(t, first, ActionAdd, "first", "1")
+	addTestPatch(t, first, ActionAdd, "shared", "first")
+	publishTestMaster(t, first)
+
+	addTestPatch(t, second, ActionAdd, "second", "2")
+	addTestPatch(t, second, ActionAdd, "shared", "second")
+	publishTestMaster(t, second)
+
+	consumer := downloadTestMaster(t, storage, filepath.Join(dir, "consumer"), nil)
+	expected := map[string][]string{
+		"first":  {"1"},
+		"second": {"2"},
+		"shared": {"second"},
+	}
+	if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+}
+
+func TestMaster_CleanupOldFiles(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+	created := time.Now().Add(-25 * time.Hour)
+	storage.Now = func() time.Time {
+		return created
+	}
+
+	publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), nil)
+	addTestPatch(t, publisher, ActionAdd, "key", "1")
+	publishTestMaster(t, publisher)
+	oldBucket := publisher.Buckets[0].RemoteFilePath
+
+	// the bucket is uploaded again under a new name, leaving the old one unreferenced
+	addTestPatch(t, publisher, ActionAdd, "key", "2")
+	publishTestMaster(t, publisher)
+	storage.Put("bucket", "lists/unreferenced-old.csv.zlib", []byte("old"))
+	created = time.Now()
+	storage.Put("bucket", "lists/unreferenced-new.csv.zlib", []byte("new"))
+
+	e := publisher.CleanupOldFiles()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	for name, kept := range map[string]bool{
+		oldBucket:                           false,
+		"lists/unreferenced-old.csv.zlib":   false,
+		"lists/unreferenced-new.csv.zlib":   true,
+		"lists/master.csv":                  true,
+		publisher.Buckets[0].RemoteFilePath: true,
+	} {
+		if _, ok := storage.Get("bucket", name); ok != kept {
+			t.Errorf("expected %s kept to be %t", name, kept)
+		}
+	}
+
+	consumer := downloadTestMaster(t, storage, filepath.Join(dir, "consumer"), nil)
+	expected := map[string][]string{"key": {"2"}}
+	if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+}
@@ -0,0 +1,472 @@
+package cbpatch
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MemoryMethodDownloadWriter    = "DownloadWriter"
+	MemoryMethodGetUploadWriter   = "GetUploadWriter"
+	MemoryMethodConditionalUpload = "GetConditionalUploadWriter"
+	MemoryMethodMakePublic        = "MakePublic"
+	MemoryMethodGetDownloadReader = "GetDownloadReader"
+	MemoryMethodLs                = "Ls"
+	MemoryMethodDelete            = "Delete"
+)
+
+// MemoryStorage is a Storage implementation which holds every object in memory.
+// It records each call made against it and allows faults to be injected, making it suitable for tests.
+type MemoryStorage struct {
+	// Now is used for object created timestamps, defaults to time.Now
+	Now        func() time.Time
+	mutex      sync.Mutex
+	objects    map[string]*memoryObject
+	generation int64
+	calls      []MemoryStorageCall
+	faults     []*MemoryFault
+}
+
+// MemoryStorageCall records a single call made against a MemoryStorage
+type MemoryStorageCall struct {
+	Method string
+	Bucket string
+	Name   string
+	Err    error
+}
+
+// MemoryFault describes a failure to inject into matching MemoryStorage calls.
+// Upload faults are raised when the writer is closed, at which point the object is discarded.
+type MemoryFault struct {
+	// Method restricts the fault to one of the MemoryMethod constants, empty matches every method
+	Method string
+	// Name restricts the fault to object names containing this string, empty matches every object
+	Name string
+	// Nth triggers the fault only on the Nth matching call (1-based), zero triggers it on every matching call
+	Nth int
+	// Err is returned from the faulted call
+	Err error
+	// Missing reports the object as not existing
+	Missing bool
+	// Truncate cuts downloaded objects down to this many bytes when positive
+	Truncate int
+	// Delay sleeps before each read or write of object data
+	Delay time.Duration
+	count int
+}
+
+type memoryObject struct {
+	Data       []byte
+	Created    time.Time
+	Generation int64
+	Etag       string
+	Public     bool
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		Now:     time.Now,
+		objects: make(map[string]*memoryObject),
+	}
+}
+
+// InjectFault registers a fault which will be applied to matching future calls
+func (m *MemoryStorage) InjectFault(fault *MemoryFault) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.faults = append(m.faults, fault)
+}
+
+// ClearFaults removes every injected fault
+func (m *MemoryStorage) ClearFaults() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.faults = nil
+}
+
+// Calls returns every call made against the storage so far, in order
+func (m *MemoryStorage) Calls() []MemoryStorageCall {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	calls := make([]MemoryStorageCall, len(m.calls))
+	copy(calls, m.calls)
+	return calls
+}
+
+// Put stores an object directly, bypassing call recording and faults
+func (m *MemoryStorage) Put(bucket string, name string, data []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.store(bucket, name, data)
+}
+
+// Get returns a copy of a stored object directly, bypassing call recording and faults
+func (m *MemoryStorage) Get(bucket string, name string) ([]byte, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	object, ok := m.objects[memoryKey(bucket, name)]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, object.Data...), true
+}
+
+// IsPublic reports whether MakePublic has been called for an object since it was last written
+func (m *MemoryStorage) IsPublic(bucket string, name string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	object, ok := m.objects[memoryKey(bucket, name)]
+	return ok && object.Public
+}
+
+func (m *MemoryStorage) DownloadWriter(ctx context.Context, bucket string, name string, writer io.Writer) error {
+	reader, e := m.download(ctx, MemoryMethodDownloadWriter, bucket, name)
+	if e != nil {
+		return e
+	}
+
+	_, e = copyContext(ctx, writer, reader)
+	return e
+}
+
+func (m *MemoryStorage) GetUploadWriter(ctx context.Context, bucket string, name string) (io.WriteCloser, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	e := ctx.Err()
+	if e != nil {
+		m.record(MemoryMethodGetUploadWriter, bucket, name, e)
+		return nil, e
+	}
+
+	fault := m.fault(MemoryMethodGetUploadWriter, name)
+	writer := &memoryWriter{
+		Ctx:     ctx,
+		Storage: m,
+		Bucket:  bucket,
+		Name:    name,
+		Fault:   fault,
+	}
+	m.record(MemoryMethodGetUploadWriter, bucket, name, nil)
+
+	return writer, nil
+}
+
+// GetConditionalUploadWriter compares preconditions against the object's Generation, or its Etag (an md5 of the
+// data, as S3 uses) when the precondition has no Generation
+func (m *MemoryStorage) GetConditionalUploadWriter(
+	ctx context.Context,
+	bucket string,
+	name string,
+	precondition Precondition,
+) (ConditionalWriter, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	e := ctx.Err()
+	if e != nil {
+		m.record(MemoryMethodConditionalUpload, bucket, name, e)
+		return nil, e
+	}
+
+	fault := m.fault(MemoryMethodConditionalUpload, name)
+	writer := &memoryWriter{
+		Ctx:          ctx,
+		Storage:      m,
+		Bucket:       bucket,
+		Name:         name,
+		Fault:        fault,
+		Precondition: &precondition,
+	}
+	m.record(MemoryMethodConditionalUpload, bucket, name, nil)
+
+	return writer, nil
+}
+
+func (m *MemoryStorage) MakePublic(ctx context.Context, bucket string, name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	e := ctx.Err()
+	if e == nil {
+		e = m.faultError(m.fault(MemoryMethodMakePublic, name))
+	}
+	if e == nil {
+		object, ok := m.objects[memoryKey(bucket, name)]
+		if ok {
+			object.Public = true
+		} else {
+			e = ErrObjectNotExist
+		}
+	}
+	m.record(MemoryMethodMakePublic, bucket, name, e)
+
+	return e
+}
+
+func (m *MemoryStorage) GetDownloadReader(ctx context.Context, bucket string, name string) (io.ReadCloser, error) {
+	reader, e := m.download(ctx, MemoryMethodGetDownloadReader, bucket, name)
+	if e != nil {
+		return nil, e
+	}
+
+	return newContextReadCloser(ctx, ioutil.NopCloser(reader)), nil
+}
+
+func (m *MemoryStorage) Ls(ctx context.Context, bucket string, dir string) ([]*ObjectInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	e := ctx.Err()
+	if e == nil {
+		e = m.faultError(m.fault(MemoryMethodLs, dir))
+	}
+	if e != nil {
+		m.record(MemoryMethodLs, bucket, dir, e)
+		return nil, e
+	}
+
+	var objects []*ObjectInfo
+	prefix := memoryKey(bucket, dir)
+	for key, object := range m.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		objects = append(objects, &ObjectInfo{
+			Name:       strings.TrimPrefix(key, memoryKey(bucket, "")),
+			Size:       int64(len(object.Data)),
+			Created:    object.Created,
+			Generation: object.Generation,
+			Etag:       object.Etag,
+		})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	m.record(MemoryMethodLs, bucket, dir, nil)
+
+	return objects, nil
+}
+
+func (m *MemoryStorage) Delete(ctx context.Context, bucket string, filePath string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	e := ctx.Err()
+	if e == nil {
+		e = m.faultError(m.fault(MemoryMethodDelete, filePath))
+	}
+	if e == nil {
+		if _, ok := m.objects[memoryKey(bucket, filePath)]; ok {
+			delete(m.objects, memoryKey(bucket, filePath))
+		} else {
+			e = ErrObjectNotExist
+		}
+	}
+	m.record(MemoryMethodDelete, bucket, filePath, e)
+
+	return e
+}
+
+func (m *MemoryStorage) download(ctx context.Context, method string, bucket string, name string) (io.Reader, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	e := ctx.Err()
+	if e != nil {
+		m.record(method, bucket, name, e)
+		return nil, e
+	}
+
+	fault := m.fault(method, name)
+	e = m.faultError(fault)
+	if e != nil {
+		m.record(method, bucket, name, e)
+		return nil, e
+	}
+
+	object, ok := m.objects[memoryKey(bucket, name)]
+	if !ok {
+		m.record(method, bucket, name, ErrObjectNotExist)
+		return nil, ErrObjectNotExist
+	}
+
+	data := append([]byte{}, object.Data...)
+	if fault != nil && fault.Truncate > 0 && fault.Truncate < len(data) {
+		data = data[:fault.Truncate]
+	}
+	m.record(method, bucket, name, nil)
+
+	var reader io.Reader = bytes.NewReader(data)
+	if fault != nil && fault.Delay > 0 {
+		reader = &slowReader{Ctx: ctx, Reader: reader, Delay: fault.Delay}
+	}
+
+	return reader, nil
+}
+
+func (m *MemoryStorage) store(bucket string, name string, data []byte) *memoryObject {
+	m.generation++
+	now := time.Now
+	if m.Now != nil {
+		now = m.Now
+	}
+	object := &memoryObject{
+		Data:       append([]byte{}, data...),
+		Created:    now(),
+		Generation: m.generation,
+		Etag:       fmt.Sprintf("\"%x\"", md5.Sum(data)),
+	}
+	m.objects[memoryKey(bucket, name)] = object
+
+	return object
+}
+
+// matches reports whether the stored object satisfies a precondition. Must be called with the mutex held.
+func (m *MemoryStorage) matches(bucket string, name string, precondition Precondition) bool {
+	object, ok := m.objects[memoryKey(bucket, name)]
+	switch {
+	case !ok:
+		return precondition.Generation == 0 && precondition.Etag == ""
+	case precondition.Generation != 0:
+		return precondition.Generation == object.Generation
+	case precondition.Etag != "":
+		return precondition.Etag == object.Etag
+	}
+
+	return false
+}
+
+// fault returns the first injected fault to apply to this call, if any. Every matching fault counts the call, so
+// Nth is the same whichever faults were injected before it. Must be called with the mutex held.
+func (m *MemoryStorage) fault(method string, name string) *MemoryFault {
+	var applied *MemoryFault
+	for _, fault := range m.faults {
+		if fault.Method != "" && fault.Method != method {
+			continue
+		}
+		if fault.Name != "" && !strings.Contains(name, fault.Name) {
+			continue
+		}
+		fault.count++
+		if applied == nil && (fault.Nth == 0 || fault.Nth == fault.count) {
+			applied = fault
+		}
+	}
+
+	return applied
+}
+
+func (m *MemoryStorage) faultError(fault *MemoryFault) error {
+	if fault == nil {
+		return nil
+	}
+	if fault.Err != nil {
+		return fault.Err
+	}
+	if fault.Missing {
+		return ErrObjectNotExist
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) record(method string, bucket string, name string, e error) {
+	m.calls = append(m.calls, MemoryStorageCall{
+		Method: method,
+		Bucket: bucket,
+		Name:   name,
+		Err:    e,
+	})
+}
+
+func memoryKey(bucket string, name string) string {
+	return bucket + "/" + name
+}
+
+type memoryWriter struct {
+	Ctx          context.Context
+	Storage      *MemoryStorage
+	Bucket       string
+	Name         string
+	Fault        *MemoryFault
+	Precondition *Precondition
+	buffer       bytes.Buffer
+	closed       bool
+	object       *ObjectInfo
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	if w.Fault != nil && w.Fault.Delay > 0 {
+		e := sleepContext(w.Ctx, w.Fault.Delay)
+		if e != nil {
+			return 0, e
+		}
+	}
+	e := w.Ctx.Err()
+	if e != nil {
+		return 0, e
+	}
+
+	return w.buffer.Write(p)
+}
+
+func (w *memoryWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	w.Storage.mutex.Lock()
+	defer w.Storage.mutex.Unlock()
+
+	e := w.Ctx.Err()
+	if e != nil {
+		return e
+	}
+	e = w.Storage.faultError(w.Fault)
+	if e != nil {
+		return e
+	}
+	if w.Precondition != nil && !w.Storage.matches(w.Bucket, w.Name, *w.Precondition) {
+		return ErrConflict
+	}
+
+	object := w.Storage.store(w.Bucket, w.Name, w.buffer.Bytes())
+	w.object = &ObjectInfo{
+		Name:       w.Name,
+		Size:       int64(len(object.Data)),
+		Created:    object.Created,
+		Generation: object.Generation,
+		Etag:       object.Etag,
+	}
+
+	return nil
+}
+
+func (w *memoryWriter) Object() *ObjectInfo {
+	return w.object
+}
+
+type slowReader struct {
+	Ctx    context.Context
+	Reader io.Reader
+	Delay  time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	e := sleepContext(r.Ctx, r.Delay)
+	if e != nil {
+		return 0, e
+	}
+
+	return r.Reader.Read(p)
+}
@@ -0,0 +1,164 @@
+package cbpatch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func putTestObject(t *testing.T, storage Storage, name string, data string) error {
+	t.Helper()
+	writer, e := storage.GetUploadWriter(context.Background(), "bucket", name)
+	if e != nil {
+		return e
+	}
+	_, e = writer.Write([]byte(data))
+	if e != nil {
+		return e
+	}
+
+	return writer.Close()
+}
+
+func TestMemoryStorage_InjectFault_Nth(t *testing.T) {
+	storage := NewMemoryStorage()
+	failure := errors.New("upload failed")
+	storage.InjectFault(&MemoryFault{
+		Method: MemoryMethodGetUploadWriter,
+		Name:   ".zlib",
+		Nth:    2,
+		Err:    failure,
+	})
+
+	for _, upload := range []struct {
+		name     string
+		expected error
+	}{
+		{"lists/1.csv.zlib", nil},
+		{"lists/master.csv", nil},
+		{"lists/2.csv.zlib", failure},
+		{"lists/3.csv.zlib", nil},
+	} {
+		e := putTestObject(t, storage, upload.name, "data")
+		if e != upload.expected {
+			t.Errorf("%s: expected %v, got %v", upload.name, upload.expected, e)
+		}
+		_, stored := storage.Get("bucket", upload.name)
+		if stored != (upload.expected == nil) {
+			t.Errorf("%s: expected stored to be %t", upload.name, upload.expected == nil)
+		}
+	}
+
+	storage.InjectFault(&MemoryFault{Method: MemoryMethodGetUploadWriter, Err: failure})
+	storage.ClearFaults()
+	e := putTestObject(t, storage, "lists/4.csv.zlib", "data")
+	if e != nil {
+		t.Errorf("expected cleared faults to be ignored, got %v", e)
+	}
+
+	calls := storage.Calls()
+	if len(calls) != 5 || calls[2].Name != "lists/2.csv.zlib" || calls[2].Method != MemoryMethodGetUploadWriter {
+		t.Errorf("expected every upload to be recorded, got %v", calls)
+	}
+}
+
+func TestMemoryStorage_InjectFault_Download(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Put("bucket", "lists/1.csv.zlib", []byte("0123456789"))
+
+	storage.InjectFault(&MemoryFault{Method: MemoryMethodDownloadWriter, Nth: 1, Truncate: 4})
+	storage.InjectFault(&MemoryFault{Method: MemoryMethodDownloadWriter, Nth: 3, Missing: true})
+	for _, expected := range []string{"0123", "0123456789", ""} {
+		var buffer bytes.Buffer
+		e := storage.DownloadWriter(context.Background(), "bucket", "lists/1.csv.zlib", &buffer)
+		if expected == "" {
+			if !errors.Is(e, ErrObjectNotExist) {
+				t.Errorf("expected ErrObjectNotExist, got %v", e)
+			}
+			continue
+		}
+		if e != nil {
+			t.Fatal(e)
+		}
+		if buffer.String() != expected {
+			t.Errorf("expected %q, got %q", expected, buffer.String())
+		}
+	}
+
+	storage.ClearFaults()
+	storage.InjectFault(&MemoryFault{Method: MemoryMethodGetDownloadReader, Delay: time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	reader, e := storage.GetDownloadReader(ctx, "bucket", "lists/1.csv.zlib")
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = io.Copy(ioutil.Discard, reader)
+	if !errors.Is(e, context.DeadlineExceeded) {
+		t.Errorf("expected a delayed read to be cancelled, got %v", e)
+	}
+}
+
+func TestMemoryStorage_GetConditionalUploadWriter(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	upload := func(precondition Precondition) (*ObjectInfo, error) {
+		writer, e := storage.GetConditionalUploadWriter(ctx, "bucket", "lists/master.csv", precondition)
+		if e != nil {
+			return nil, e
+		}
+		e = writer.Close()
+		return writer.Object(), e
+	}
+
+	first, e := upload(Precondition{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = upload(Precondition{})
+	if !errors.Is(e, ErrConflict) {
+		t.Errorf("expected ErrConflict creating an existing object, got %v", e)
+	}
+	second, e := upload(Precondition{Generation: first.Generation})
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = upload(Precondition{Generation: first.Generation})
+	if !errors.Is(e, ErrConflict) {
+		t.Errorf("expected ErrConflict replacing a stale generation, got %v", e)
+	}
+	_, e = upload(Precondition{Etag: second.Etag})
+	if e != nil {
+		t.Errorf("expected a matching etag to be accepted, got %v", e)
+	}
+}
+
+func TestMemoryStorage_MakePublic(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	storage.Put("bucket", "lists/master.csv", []byte("v1"))
+
+	e := storage.MakePublic(ctx, "bucket", "lists/master.csv")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !storage.IsPublic("bucket", "lists/master.csv") {
+		t.Error("expected the object to be public")
+	}
+	e = putTestObject(t, storage, "lists/master.csv", "v2")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if storage.IsPublic("bucket", "lists/master.csv") {
+		t.Error("expected a rewritten object to be private again")
+	}
+
+	e = storage.MakePublic(ctx, "bucket", "lists/missing.csv")
+	if !errors.Is(e, ErrObjectNotExist) {
+		t.Errorf("expected ErrObjectNotExist, got %v", e)
+	}
+}
@@ -1,15 +1,34 @@
 package cbpatch
 
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expirySeparator follows the action in the first column of a bucket row for a patch which expires
+const expirySeparator = "@"
+
 type Patch interface {
 	GetAction() string
 	GetKey() string
 	GetValues() []string
 }
 
+// ExpiringPatch is implemented by patches which set a key until a point in time, a zero time never expires.
+// Only add patches may expire, changes to the key's values keep the expiry of the patch which set it. The expiry is
+// stored in the action column of the bucket row as "+@<unix time>", which older versions of this package do not
+// understand. Validation is given the row with the expiry removed.
+type ExpiringPatch interface {
+	Patch
+	GetExpires() time.Time
+}
+
 type DefaultPatch struct {
-	Action string
-	Key    string
-	Values []string
+	Action  string
+	Key     string
+	Values  []string
+	Expires time.Time
 }
 
 func (d *DefaultPatch) GetAction() string {
@@ -23,3 +42,75 @@ func (d *DefaultPatch) GetKey() string {
 func (d *DefaultPatch) GetValues() []string {
 	return d.Values
 }
+
+func (d *DefaultPatch) GetExpires() time.Time {
+	return d.Expires
+}
+
+// patchExpires returns when the patch expires, or the zero time if it does not
+func patchExpires(patch Patch) time.Time {
+	expiringPatch, ok := patch.(ExpiringPatch)
+	if !ok {
+		return time.Time{}
+	}
+
+	return expiringPatch.GetExpires()
+}
+
+// patchRow returns the patch as a bucket csv row, the action of an expiring patch is followed by the unix time it
+// expires at
+func patchRow(patch Patch) []string {
+	action := patch.GetAction()
+	expires := patchExpires(patch)
+	if !expires.IsZero() {
+		action += expirySeparator + strconv.FormatInt(expires.Unix(), 10)
+	}
+
+	return append([]string{
+		action,
+		patch.GetKey(),
+	}, patch.GetValues()...)
+}
+
+// patchFromLine converts a bucket csv row of at least 2 columns into a patch, copying it so the row can be reused
+func patchFromLine(line []string) Patch {
+	values := make([]string, len(line)-2)
+	copy(values, line[2:])
+
+	action, expires := splitExpiry(line[0])
+
+	return &DefaultPatch{
+		Action:  action,
+		Key:     line[1],
+		Values:  values,
+		Expires: expires,
+	}
+}
+
+// splitExpiry separates the action in the first column of a bucket row from the time it expires, which is zero
+// when it does not
+func splitExpiry(column string) (string, time.Time) {
+	index := strings.LastIndex(column, expirySeparator)
+	if index > 0 {
+		unixTime, e := strconv.ParseInt(column[index+1:], 10, 64)
+		if e == nil {
+			return column[:index], time.Unix(unixTime, 0)
+		}
+	}
+
+	return column, time.Time{}
+}
+
+// validationLine returns the bucket row given to the validation function, with the expiry removed from the action
+// so validation sees the same row whether or not the patch expires
+func validationLine(line []string) []string {
+	if len(line) == 0 {
+		return line
+	}
+	action, expires := splitExpiry(line[0])
+	if expires.IsZero() {
+		return line
+	}
+
+	return append([]string{action}, line[1:]...)
+}
@@ -0,0 +1,136 @@
+package cbpatch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPatchRow_Expiry(t *testing.T) {
+	expires := time.Unix(1700000000, 0)
+	row := patchRow(&DefaultPatch{Action: string(ActionAdd), Key: "key", Values: []string{"a", "b"}, Expires: expires})
+	expected := []string{"+@1700000000", "key", "a", "b"}
+	if !reflect.DeepEqual(row, expected) {
+		t.Errorf("expected %v, got %v", expected, row)
+	}
+
+	patch := patchFromLine(row)
+	if patch.GetAction() != string(ActionAdd) || !patchExpires(patch).Equal(expires) {
+		t.Errorf("expected an add patch expiring at %s, got %+v", expires, patch)
+	}
+	if line := validationLine(row); !reflect.DeepEqual(line, []string{"+", "key", "a", "b"}) {
+		t.Errorf("expected the expiry to be removed for validation, got %v", line)
+	}
+	if row[0] != "+@1700000000" {
+		t.Errorf("expected the row to be left alone, got %v", row)
+	}
+
+	row = patchRow(&DefaultPatch{Action: string(ActionAdd), Key: "key", Values: []string{"a"}})
+	if !reflect.DeepEqual(row, []string{"+", "key", "a"}) || !patchExpires(patchFromLine(row)).IsZero() {
+		t.Errorf("expected a patch without an expiry, got %v", row)
+	}
+}
+
+func TestMaster_AddPatch_Expiry(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	m := downloadTestMaster(t, NewMemoryStorage(), dir, nil)
+
+	e := m.AddPatch(&DefaultPatch{
+		Action:  string(ActionAppend),
+		Key:     "key",
+		Values:  []string{"value"},
+		Expires: time.Now().Add(time.Hour),
+	})
+	if !errors.Is(e, ErrInvalidPatch) {
+		t.Errorf("expected only add patches to expire, got %v", e)
+	}
+}
+
+func TestMaster_CompileListAsOf(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+	now := time.Unix(1700000000, 0)
+	clock := func(config *Config) {
+		config.Clock = func() time.Time {
+			return now
+		}
+	}
+
+	publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), clock)
+	addTestPatch(t, publisher, ActionAdd, "forever", "1")
+	for _, patch := range []*DefaultPatch{
+		{Action: string(ActionAdd), Key: "soon", Values: []string{"1"}, Expires: now.Add(time.Minute)},
+		{Action: string(ActionAdd), Key: "later", Values: []string{"1"}, Expires: now.Add(time.Hour)},
+		{Action: string(ActionAdd), Key: "expired", Values: []string{"1"}, Expires: now.Add(-time.Minute)},
+	} {
+		e := publisher.AddPatch(patch)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	// changing the values keeps the expiry of the patch which set the key
+	addTestPatch(t, publisher, ActionAppend, "soon", "2")
+	publishTestMaster(t, publisher)
+
+	// validation is given the action without the expiry
+	var actions []string
+	consumer := downloadTestMaster(t, storage, filepath.Join(dir, "consumer"), func(config *Config) {
+		clock(config)
+		config.Validation = func(line []string, bucket *Bucket) error {
+			actions = append(actions, line[0])
+			if !Action(line[0]).Valid() {
+				return errors.New("unknown action " + line[0])
+			}
+			return nil
+		}
+	})
+	if len(actions) == 0 {
+		t.Error("expected the rows to be validated")
+	}
+
+	expected := map[string][]string{"forever": {"1"}, "soon": {"1", "2"}, "later": {"1"}}
+	if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+	list, e := consumer.CompileListAsOf(now.Add(30 * time.Minute))
+	if e != nil {
+		t.Fatal(e)
+	}
+	expected = map[string][]string{"forever": {"1"}, "later": {"1"}}
+	if !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+
+	// compaction leaves out the expired keys and keeps the expiry of the others
+	e = publisher.Compact()
+	if e != nil {
+		t.Fatal(e)
+	}
+	compacted := downloadTestMaster(t, storage, filepath.Join(dir, "compacted"), clock)
+	total := 0
+	e = compacted.Replay(func(patch Patch) error {
+		total++
+		if patch.GetKey() == "later" && !patchExpires(patch).Equal(now.Add(time.Hour)) {
+			t.Errorf("expected the compacted patch to keep its expiry, got %s", patchExpires(patch))
+		}
+		return nil
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if total != 3 {
+		t.Errorf("expected a patch for each key which has not expired, got %d", total)
+	}
+	list, e = compacted.CompileListAsOf(now.Add(2 * time.Hour))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if expected = map[string][]string{"forever": {"1"}}; !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+}
@@ -0,0 +1,55 @@
+package cbpatch
+
+import (
+	"context"
+	"sync"
+)
+
+// runParallel calls work for every index in [0, count) using at most concurrency goroutines.
+// The first error cancels the context passed to any remaining work and is returned.
+func runParallel(ctx context.Context, count int, concurrency int, work func(ctx context.Context, i int) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > count {
+		concurrency = count
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	indexes := make(chan int)
+	var firstError error
+	var once sync.Once
+	var wait sync.WaitGroup
+	for worker := 0; worker < concurrency; worker++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for i := range indexes {
+				e := work(ctx, i)
+				if e != nil {
+					once.Do(func() {
+						firstError = e
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		if ctx.Err() != nil {
+			break
+		}
+		indexes <- i
+	}
+	close(indexes)
+	wait.Wait()
+
+	if firstError != nil {
+		return firstError
+	}
+
+	return ctx.Err()
+}
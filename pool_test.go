@@ -0,0 +1,169 @@
+package cbpatch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrencyStorage records the most bucket downloads and uploads which were in progress at once, holding each
+// for a moment so concurrent ones overlap
+type concurrencyStorage struct {
+	Storage
+	mutex       sync.Mutex
+	downloads   int
+	uploads     int
+	MaxDownload int
+	MaxUpload   int
+}
+
+func (c *concurrencyStorage) track(active *int, max *int, delta int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	*active += delta
+	if *active > *max {
+		*max = *active
+	}
+}
+
+func (c *concurrencyStorage) DownloadWriter(ctx context.Context, bucket string, name string, writer io.Writer) error {
+	c.track(&c.downloads, &c.MaxDownload, 1)
+	defer c.track(&c.downloads, &c.MaxDownload, -1)
+	time.Sleep(20 * time.Millisecond)
+
+	return c.Storage.DownloadWriter(ctx, bucket, name, writer)
+}
+
+func (c *concurrencyStorage) GetUploadWriter(ctx context.Context, bucket string, name string) (io.WriteCloser, error) {
+	writer, e := c.Storage.GetUploadWriter(ctx, bucket, name)
+	if e != nil {
+		return nil, e
+	}
+	c.track(&c.uploads, &c.MaxUpload, 1)
+
+	return &concurrencyWriter{WriteCloser: writer, storage: c}, nil
+}
+
+type concurrencyWriter struct {
+	io.WriteCloser
+	storage *concurrencyStorage
+}
+
+func (c *concurrencyWriter) Close() error {
+	defer c.storage.track(&c.storage.uploads, &c.storage.MaxUpload, -1)
+	time.Sleep(20 * time.Millisecond)
+
+	return c.WriteCloser.Close()
+}
+
+func TestRunParallel(t *testing.T) {
+	var mutex sync.Mutex
+	done := make(map[int]bool)
+	e := runParallel(context.Background(), 10, 3, func(ctx context.Context, i int) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		done[i] = true
+		return nil
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(done) != 10 {
+		t.Errorf("expected every index to be worked on, got %v", done)
+	}
+
+	failure := errors.New("failed")
+	started := 0
+	e = runParallel(context.Background(), 10, 1, func(ctx context.Context, i int) error {
+		started++
+		if i == 2 {
+			return failure
+		}
+		return nil
+	})
+	if e != failure {
+		t.Errorf("expected the first error, got %v", e)
+	}
+	if started != 3 {
+		t.Errorf("expected no work to start after the error, got %d started", started)
+	}
+}
+
+func TestMaster_DownloadConcurrency(t *testing.T) {
+	for _, concurrency := range []int{0, 3} {
+		dir := newTestDir(t)
+		storage := NewMemoryStorage()
+
+		publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), nil)
+		for bucketNumber := 1; bucketNumber <= 6; bucketNumber++ {
+			if bucketNumber > 1 {
+				_, e := publisher.newBucket(bucketNumber)
+				if e != nil {
+					t.Fatal(e)
+				}
+			}
+			addTestPatch(t, publisher, ActionAdd, strconv.Itoa(bucketNumber), "value")
+		}
+		publishTestMaster(t, publisher)
+		expected := compileTestList(t, publisher)
+
+		tracked := &concurrencyStorage{Storage: storage}
+		consumer := downloadTestMaster(t, tracked, filepath.Join(dir, "consumer"), func(config *Config) {
+			config.DownloadConcurrency = concurrency
+		})
+		expectedMax := concurrency
+		if expectedMax == 0 {
+			expectedMax = 1
+		}
+		if tracked.MaxDownload != expectedMax {
+			t.Errorf("concurrency %d: expected %d downloads at once, got %d", concurrency, expectedMax,
+				tracked.MaxDownload)
+		}
+		if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+			t.Errorf("concurrency %d: expected %v, got %v", concurrency, expected, list)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMaster_UploadConcurrency(t *testing.T) {
+	for _, concurrency := range []int{0, 3} {
+		dir := newTestDir(t)
+		tracked := &concurrencyStorage{Storage: NewMemoryStorage()}
+
+		publisher := downloadTestMaster(t, tracked, filepath.Join(dir, "publisher"), func(config *Config) {
+			config.UploadConcurrency = concurrency
+		})
+		for bucketNumber := 1; bucketNumber <= 6; bucketNumber++ {
+			if bucketNumber > 1 {
+				_, e := publisher.newBucket(bucketNumber)
+				if e != nil {
+					t.Fatal(e)
+				}
+			}
+			addTestPatch(t, publisher, ActionAdd, strconv.Itoa(bucketNumber), "value")
+		}
+		publishTestMaster(t, publisher)
+		expected := compileTestList(t, publisher)
+
+		expectedMax := concurrency
+		if expectedMax == 0 {
+			expectedMax = 1
+		}
+		if tracked.MaxUpload != expectedMax {
+			t.Errorf("concurrency %d: expected %d uploads at once, got %d", concurrency, expectedMax, tracked.MaxUpload)
+		}
+		consumer := downloadTestMaster(t, tracked, filepath.Join(dir, "consumer"), nil)
+		if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+			t.Errorf("concurrency %d: expected %v, got %v", concurrency, expected, list)
+		}
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,434 @@
+package cbpatch
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	journalPhaseStaging   = "staging"
+	journalPhaseVerified  = "verified"
+	journalPhaseCommitted = "committed"
+)
+
+// publishJournal records an in progress publish in Dir so it can be resumed or rolled back after a crash.
+// Staged maps the remote path of every object uploaded by the publish to its expected zipped checksum, which is
+// empty until the object has been uploaded. Rows holds the master csv to write once every object is verified.
+type publishJournal struct {
+	Phase        string
+	Precondition Precondition
+	Staged       map[string]string
+	Rows         [][]string
+}
+
+func (m *Master) journalPath() string {
+	return filepath.Join(m.Dir, m.FileName+".journal")
+}
+
+func (m *Master) writeJournal(journal *publishJournal) error {
+	var buffer bytes.Buffer
+	journalCsv := csv.NewWriter(&buffer)
+	e := journalCsv.Write([]string{
+		"phase",
+		journal.Phase,
+		strconv.FormatInt(journal.Precondition.Generation, 10),
+		journal.Precondition.Etag,
+	})
+	if e != nil {
+		return e
+	}
+	for remotePath, zippedHash := range journal.Staged {
+		e = journalCsv.Write([]string{"staged", remotePath, zippedHash})
+		if e != nil {
+			return e
+		}
+	}
+	for _, row := range journal.Rows {
+		e = journalCsv.Write(append([]string{"master"}, row...))
+		if e != nil {
+			return e
+		}
+	}
+	journalCsv.Flush()
+	e = journalCsv.Error()
+	if e != nil {
+		return e
+	}
+
+	// replace the journal atomically so a crash never leaves it half written
+	temporaryPath := m.journalPath() + ".tmp"
+	e = ioutil.WriteFile(temporaryPath, buffer.Bytes(), os.ModePerm)
+	if e != nil {
+		return e
+	}
+
+	return os.Rename(temporaryPath, m.journalPath())
+}
+
+// readJournal returns the journal of an interrupted publish, or nil if there is none
+func (m *Master) readJournal() (*publishJournal, error) {
+	file, e := os.Open(m.journalPath())
+	if os.IsNotExist(e) {
+		return nil, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+	defer file.Close()
+
+	journal := &publishJournal{
+		Staged: make(map[string]string),
+	}
+	journalCsv := csv.NewReader(file)
+	journalCsv.FieldsPerRecord = -1
+	lineNumber := 0
+	for true {
+		line, e := journalCsv.Read()
+		if e == io.EOF {
+			break
+		}
+		lineNumber++
+		if e != nil {
+			return nil, &MalformedRowError{Path: m.journalPath(), Line: lineNumber, Reason: "unreadable csv", Err: e}
+		}
+
+		switch {
+		case line[0] == "phase" && len(line) == 4:
+			journal.Phase = line[1]
+			journal.Precondition.Etag = line[3]
+			journal.Precondition.Generation, e = strconv.ParseInt(line[2], 10, 64)
+			if e != nil {
+				return nil, &MalformedRowError{Path: m.journalPath(), Line: lineNumber, Reason: "invalid generation", Err: e}
+			}
+		case line[0] == "staged" && len(line) == 3:
+			journal.Staged[line[1]] = line[2]
+		case line[0] == "master" && len(line) > 1:
+			journal.Rows = append(journal.Rows, line[1:])
+		default:
+			return nil, &MalformedRowError{Path: m.journalPath(), Line: lineNumber, Reason: "unknown journal row"}
+		}
+	}
+
+	return journal, nil
+}
+
+func (m *Master) removeJournal() error {
+	e := os.Remove(m.journalPath())
+	if os.IsNotExist(e) {
+		return nil
+	}
+
+	return e
+}
+
+// HasInterruptedPublish reports whether a previous publish from this Dir did not complete
+func (m *Master) HasInterruptedPublish() (bool, error) {
+	journal, e := m.readJournal()
+	return journal != nil, e
+}
+
+func (m *Master) RecoverPublish() error {
+	return m.RecoverPublishContext(context.Background())
+}
+
+// RecoverPublishContext finishes a publish which was interrupted after all of its objects were verified,
+// otherwise it deletes the objects the publish staged. A publish whose master was already written is always
+// finished, as consumers may be using its objects. Download the master again afterwards.
+func (m *Master) RecoverPublishContext(ctx context.Context) error {
+	if m.ReadOnly {
+		return ErrReadOnly
+	}
+	e := m.checkPublishLock()
+	if e != nil {
+		return e
+	}
+
+	journal, e := m.readJournal()
+	if e != nil {
+		m.ErrorHandler.Error(e)
+		return e
+	}
+	if journal == nil {
+		return nil
+	}
+
+	if journal.Phase == journalPhaseCommitted {
+		m.Logger.InfoF("debug", "finishing interrupted publish")
+		return m.commitPublish(ctx, journal)
+	}
+
+	if journal.Phase == journalPhaseVerified {
+		m.Logger.InfoF("debug", "resuming interrupted publish")
+		e = m.verifyStaged(ctx, journal)
+		if e == nil {
+			e = m.commitPublish(ctx, journal)
+		}
+		if errors.Is(e, ErrConflict) {
+			// the publish may have written the master before it could record doing so
+			committed, matchE := m.remoteMasterMatches(ctx, journal.Rows)
+			if matchE != nil {
+				m.ErrorHandler.Error(matchE)
+				return matchE
+			}
+			if committed {
+				m.Logger.InfoF("debug", "interrupted publish already wrote the master, finishing it")
+				journal.Phase = journalPhaseCommitted
+				return m.commitPublish(ctx, journal)
+			}
+		}
+		if e == nil || !(errors.Is(e, ErrChecksumMismatch) || errors.Is(e, ErrNotFound) || errors.Is(e, ErrConflict)) {
+			return e
+		}
+	}
+
+	m.Logger.InfoF("debug", "rolling back interrupted publish")
+	return m.rollbackPublish(ctx, journal)
+}
+
+func (m *Master) Rebase() error {
+	return m.RebaseContext(context.Background())
+}
+
+// RebaseContext discards local changes, downloads the latest remote master and its buckets, then replays the
+// patches added since the master was last downloaded or published on top of them
+func (m *Master) RebaseContext(ctx context.Context) error {
+	if m.ReadOnly {
+		return ErrReadOnly
+	}
+
+	pendingPatches := m.PendingPatches
+	hadCategories := m.Categories != nil
+
+	e := m.RefreshContext(ctx)
+	if e != nil {
+		return e
+	}
+	if hadCategories {
+		e = m.InitCategories()
+		if e != nil {
+			return e
+		}
+	}
+
+	for _, patch := range pendingPatches {
+		e = m.AddPatch(patch)
+		if e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// verifyStaged downloads every staged object and checks it against the checksum it was uploaded with
+func (m *Master) verifyStaged(ctx context.Context, journal *publishJournal) error {
+	var remotePaths []string
+	for remotePath := range journal.Staged {
+		remotePaths = append(remotePaths, remotePath)
+	}
+
+	return runParallel(ctx, len(remotePaths), m.UploadConcurrency, func(ctx context.Context, i int) error {
+		remotePath := remotePaths[i]
+		hash := md5.New()
+		e := m.Storage.DownloadWriter(ctx, m.StorageBucketName, remotePath, hash)
+		if e != nil {
+			return e
+		}
+
+		checksum := fmt.Sprintf("%x", hash.Sum(nil))
+		if checksum != journal.Staged[remotePath] {
+			return &ChecksumMismatchError{
+				Path:     remotePath,
+				Zipped:   true,
+				Expected: journal.Staged[remotePath],
+				Actual:   checksum,
+			}
+		}
+		m.Logger.DebugF("debug", "verified staged object: %s", remotePath)
+
+		return nil
+	})
+}
+
+// commitPublish writes the journalled master remotely, provided the remote master is still the version the
+// publish started from, then locally, then discards the journal. The journal is marked committed as soon as the
+// remote master is written, so the publish is never rolled back afterwards.
+func (m *Master) commitPublish(ctx context.Context, journal *publishJournal) error {
+	remotePath := joinPath(m.RemoteDir, m.FileName)
+	if journal.Phase != journalPhaseCommitted {
+		var buffer bytes.Buffer
+		masterCsv := csv.NewWriter(&buffer)
+		e := masterCsv.WriteAll(journal.Rows)
+		if e != nil {
+			return e
+		}
+
+		m.Logger.InfoF("debug", "uploading: %s", remotePath)
+
+		storageWriter, e := m.Storage.GetConditionalUploadWriter(
+			ctx,
+			m.StorageBucketName,
+			remotePath,
+			journal.Precondition,
+		)
+		if e != nil {
+			return e
+		}
+		_, e = copyContext(ctx, storageWriter, &buffer)
+		if e != nil {
+			return e
+		}
+		e = storageWriter.Close()
+		if errors.Is(e, ErrConflict) {
+			return &ConflictError{
+				Path:         remotePath,
+				Precondition: journal.Precondition,
+			}
+		}
+		if e != nil {
+			return e
+		}
+		m.Precondition = PreconditionFor(storageWriter.Object())
+
+		journal.Phase = journalPhaseCommitted
+		e = m.writeJournal(journal)
+		if e != nil {
+			return e
+		}
+	}
+	m.PendingPatches = nil
+
+	if m.Public {
+		e := m.Storage.MakePublic(ctx, m.StorageBucketName, remotePath)
+		if e != nil {
+			return e
+		}
+	}
+
+	e := m.File.Truncate(0)
+	if e != nil {
+		return e
+	}
+	_, e = m.File.Seek(0, io.SeekStart)
+	if e != nil {
+		return e
+	}
+	masterCsv := csv.NewWriter(m.File)
+	e = masterCsv.WriteAll(journal.Rows)
+	if e != nil {
+		return e
+	}
+
+	return m.removeJournal()
+}
+
+// rollbackPublish deletes every object a publish staged and discards its journal. Changed buckets are staged again
+// by the next publish, as are the categories if they were staged.
+func (m *Master) rollbackPublish(ctx context.Context, journal *publishJournal) error {
+	for remotePath := range journal.Staged {
+		m.Logger.DebugF("debug", "deleting staged object: %s", remotePath)
+		e := m.Storage.Delete(ctx, m.StorageBucketName, remotePath)
+		if e != nil && !errors.Is(e, ErrNotFound) {
+			m.ErrorHandler.Error(e)
+			return e
+		}
+	}
+
+	// the categories were hashed when they were staged, so they would no longer be seen as changed
+	if m.Categories != nil {
+		if _, staged := journal.Staged[m.Categories.RemoteFilePath]; staged {
+			m.Categories.UnzippedHash = ""
+			m.Categories.ZippedHash = ""
+		}
+	}
+
+	return m.removeJournal()
+}
+
+// remoteMaster describes the remote master object, nil when it does not exist
+func (m *Master) remoteMaster(ctx context.Context) (*ObjectInfo, error) {
+	remotePath := joinPath(m.RemoteDir, m.FileName)
+	files, e := m.Storage.Ls(ctx, m.StorageBucketName, remotePath)
+	if e != nil {
+		return nil, e
+	}
+	for _, file := range files {
+		if file.Name == remotePath {
+			return file, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// publishPrecondition returns the precondition for writing the remote master, provided it still holds what was
+// downloaded, otherwise a ConflictError. The version is read before the content, so a concurrent publish can only
+// cause a spurious conflict.
+func (m *Master) publishPrecondition(ctx context.Context) (Precondition, error) {
+	remoteMaster, e := m.remoteMaster(ctx)
+	if e != nil {
+		m.ErrorHandler.Error(e)
+		return Precondition{}, e
+	}
+	precondition := PreconditionFor(remoteMaster)
+
+	var remote []byte
+	if remoteMaster != nil {
+		remote, e = m.readRemoteMaster(ctx)
+		if e != nil {
+			m.ErrorHandler.Error(e)
+			return Precondition{}, e
+		}
+	}
+	downloaded, e := checksumReadSeeker(m.File)
+	if e != nil {
+		m.ErrorHandler.Error(e)
+		return Precondition{}, e
+	}
+	if fmt.Sprintf("%x", md5.Sum(remote)) != downloaded {
+		e = &ConflictError{
+			Path:         joinPath(m.RemoteDir, m.FileName),
+			Precondition: precondition,
+		}
+		m.ErrorHandler.Error(e)
+		return Precondition{}, e
+	}
+
+	return precondition, nil
+}
+
+// readRemoteMaster returns the content of the remote master, which is empty when it does not exist
+func (m *Master) readRemoteMaster(ctx context.Context) ([]byte, error) {
+	var buffer bytes.Buffer
+	e := m.Storage.DownloadWriter(ctx, m.StorageBucketName, joinPath(m.RemoteDir, m.FileName), &buffer)
+	if e != nil && !errors.Is(e, ErrNotFound) {
+		return nil, e
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// remoteMasterMatches reports whether the remote master holds exactly the given rows
+func (m *Master) remoteMasterMatches(ctx context.Context, rows [][]string) (bool, error) {
+	remote, e := m.readRemoteMaster(ctx)
+	if e != nil {
+		return false, e
+	}
+
+	var expected bytes.Buffer
+	e = csv.NewWriter(&expected).WriteAll(rows)
+	if e != nil {
+		return false, e
+	}
+
+	return bytes.Equal(remote, expected.Bytes()), nil
+}
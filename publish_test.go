@@ -0,0 +1,170 @@
+package cbpatch
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMaster_RecoverPublish_FailedUpload(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+
+	publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), func(config *Config) {
+		config.CategoryItems = []CategoriesItem{testCategoriesItem{id: 1, category: "category"}}
+	})
+	e := publisher.InitCategories()
+	if e != nil {
+		t.Fatal(e)
+	}
+	addTestPatch(t, publisher, ActionAdd, "first", "1")
+	_, e = publisher.newBucket(2)
+	if e != nil {
+		t.Fatal(e)
+	}
+	addTestPatch(t, publisher, ActionAdd, "second", "2")
+
+	// the categories and the first bucket are staged, the second bucket fails
+	storage.InjectFault(&MemoryFault{
+		Method: MemoryMethodGetUploadWriter,
+		Nth:    3,
+		Err:    errors.New("upload failed"),
+	})
+	e = publisher.UploadToStorageBucket()
+	if e == nil {
+		t.Fatal("expected the publish to fail")
+	}
+	storage.ClearFaults()
+
+	interrupted, e := publisher.HasInterruptedPublish()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !interrupted {
+		t.Fatal("expected an interrupted publish")
+	}
+	e = publisher.UploadToStorageBucket()
+	if !errors.Is(e, ErrInterruptedPublish) {
+		t.Fatalf("expected ErrInterruptedPublish, got %v", e)
+	}
+
+	e = publisher.RecoverPublish()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, ok := storage.Get("bucket", "lists/master.csv"); ok {
+		t.Error("no master should have been written")
+	}
+	files, e := storage.Ls(context.Background(), "bucket", "lists")
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, file := range files {
+		t.Errorf("staged object was not rolled back: %s", file.Name)
+	}
+
+	publishTestMaster(t, publisher)
+	consumer := downloadTestMaster(t, storage, filepath.Join(dir, "consumer"), nil)
+	expected := map[string][]string{"first": {"1"}, "second": {"2"}}
+	if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+	if consumer.Categories == nil || consumer.Categories.UnzippedHash != publisher.Categories.UnzippedHash {
+		t.Errorf("expected the published categories")
+	}
+}
+
+func TestMaster_RecoverPublish_AfterCommit(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+
+	publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), func(config *Config) {
+		config.Public = true
+	})
+	addTestPatch(t, publisher, ActionAdd, "key", "value")
+
+	// the master is written but the publish fails before the journal is removed
+	storage.InjectFault(&MemoryFault{
+		Method: MemoryMethodMakePublic,
+		Name:   "master.csv",
+		Nth:    1,
+		Err:    errors.New("acl failed"),
+	})
+	e := publisher.UploadToStorageBucket()
+	if e == nil {
+		t.Fatal("expected the publish to fail")
+	}
+
+	e = publisher.RecoverPublish()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !storage.IsPublic("bucket", "lists/master.csv") {
+		t.Error("expected the recovered master to be public")
+	}
+	interrupted, e := publisher.HasInterruptedPublish()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if interrupted {
+		t.Error("expected the journal to be removed")
+	}
+
+	consumer := downloadTestMaster(t, storage, filepath.Join(dir, "consumer"), nil)
+	expected := map[string][]string{"key": {"value"}}
+	if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+}
+
+func TestMaster_RecoverPublish_MasterWrittenBeforeCommitRecorded(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+
+	publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), nil)
+	addTestPatch(t, publisher, ActionAdd, "key", "value")
+	publishTestMaster(t, publisher)
+
+	// recreate the journal of a publish which crashed right after writing the master
+	_, e := publisher.File.Seek(0, io.SeekStart)
+	if e != nil {
+		t.Fatal(e)
+	}
+	reader := csv.NewReader(publisher.File)
+	reader.FieldsPerRecord = -1
+	rows, e := reader.ReadAll()
+	if e != nil {
+		t.Fatal(e)
+	}
+	bucket := publisher.Buckets[0]
+	e = publisher.writeJournal(&publishJournal{
+		Phase:  journalPhaseVerified,
+		Staged: map[string]string{bucket.RemoteFilePath: bucket.ZippedHash},
+		Rows:   rows,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	e = publisher.RecoverPublish()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, ok := storage.Get("bucket", bucket.RemoteFilePath); !ok {
+		t.Fatal("the published bucket was rolled back")
+	}
+
+	consumer := downloadTestMaster(t, storage, filepath.Join(dir, "consumer"), nil)
+	expected := map[string][]string{"key": {"value"}}
+	if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+}
@@ -0,0 +1,418 @@
+package cbpatch
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3DateFormat     = "20060102"
+	s3DateTimeFormat = "20060102T150405Z"
+	s3Algorithm      = "AWS4-HMAC-SHA256"
+)
+
+// S3Storage is a Storage implementation for Amazon S3 and S3-compatible services such as MinIO.
+// Requests are signed with AWS signature version 4, anonymous requests are made when AccessKeyId is empty.
+type S3Storage struct {
+	// Endpoint is the service URL, e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	Endpoint        string
+	Region          string
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	// PathStyle addresses buckets as Endpoint/bucket/key rather than as a bucket subdomain of Endpoint
+	PathStyle bool
+	Client    *http.Client
+}
+
+func NewS3Storage(endpoint, region, accessKeyId, secretAccessKey string, pathStyle bool) *S3Storage {
+	return &S3Storage{
+		Endpoint:        strings.TrimSuffix(endpoint, "/"),
+		Region:          region,
+		AccessKeyId:     accessKeyId,
+		SecretAccessKey: secretAccessKey,
+		PathStyle:       pathStyle,
+		Client:          http.DefaultClient,
+	}
+}
+
+func (s *S3Storage) DownloadWriter(ctx context.Context, bucket string, name string, writer io.Writer) error {
+	reader, e := s.GetDownloadReader(ctx, bucket, name)
+	if e != nil {
+		return e
+	}
+	defer reader.Close()
+
+	_, e = copyContext(ctx, writer, reader)
+	return e
+}
+
+func (s *S3Storage) GetUploadWriter(ctx context.Context, bucket string, name string) (io.WriteCloser, error) {
+	return &s3Writer{
+		Ctx:     ctx,
+		Storage: s,
+		Bucket:  bucket,
+		Name:    name,
+	}, nil
+}
+
+// GetConditionalUploadWriter uses S3 conditional writes, preconditions are compared against the object's ETag
+func (s *S3Storage) GetConditionalUploadWriter(
+	ctx context.Context,
+	bucket string,
+	name string,
+	precondition Precondition,
+) (ConditionalWriter, error) {
+	headers := map[string]string{
+		"If-None-Match": "*",
+	}
+	if precondition.Etag != "" {
+		headers = map[string]string{
+			"If-Match": precondition.Etag,
+		}
+	}
+
+	return &s3Writer{
+		Ctx:     ctx,
+		Storage: s,
+		Bucket:  bucket,
+		Name:    name,
+		Headers: headers,
+	}, nil
+}
+
+func (s *S3Storage) MakePublic(ctx context.Context, bucket string, name string) error {
+	response, e := s.do(ctx, http.MethodPut, bucket, name, url.Values{"acl": {""}}, map[string]string{
+		"x-amz-acl": "public-read",
+	}, nil)
+	if e != nil {
+		return e
+	}
+
+	return response.Body.Close()
+}
+
+func (s *S3Storage) GetDownloadReader(ctx context.Context, bucket string, name string) (io.ReadCloser, error) {
+	response, e := s.do(ctx, http.MethodGet, bucket, name, nil, nil, nil)
+	if e != nil {
+		return nil, e
+	}
+
+	return response.Body, nil
+}
+
+func (s *S3Storage) Ls(ctx context.Context, bucket string, dir string) ([]*ObjectInfo, error) {
+	var objects []*ObjectInfo
+	continuationToken := ""
+	for true {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {dir},
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		response, e := s.do(ctx, http.MethodGet, bucket, "", query, nil, nil)
+		if e != nil {
+			return nil, e
+		}
+
+		var result s3ListBucketResult
+		e = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if e != nil {
+			return nil, e
+		}
+
+		for _, content := range result.Contents {
+			objects = append(objects, &ObjectInfo{
+				Name:       content.Key,
+				Size:       content.Size,
+				Created:    content.LastModified,
+				Generation: content.LastModified.UnixNano(),
+				Etag:       content.ETag,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+
+	return objects, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, bucket string, filePath string) error {
+	response, e := s.do(ctx, http.MethodDelete, bucket, filePath, nil, nil, nil)
+	if e != nil {
+		return e
+	}
+
+	return response.Body.Close()
+}
+
+// PublicUrl returns the plain HTTP(S) URL an object can be fetched from once it has been made public
+func (s *S3Storage) PublicUrl(bucket string, name string) string {
+	return s.objectUrl(bucket, name).String()
+}
+
+func (s *S3Storage) objectUrl(bucket string, name string) *url.URL {
+	endpoint, e := url.Parse(s.Endpoint)
+	if e != nil || endpoint.Host == "" {
+		endpoint = &url.URL{Scheme: "https", Host: s.Endpoint}
+	}
+
+	objectUrl := &url.URL{
+		Scheme: endpoint.Scheme,
+		Host:   endpoint.Host,
+	}
+	path := strings.TrimSuffix(endpoint.Path, "/")
+	if s.PathStyle {
+		path += "/" + bucket
+	} else {
+		objectUrl.Host = bucket + "." + endpoint.Host
+	}
+	path += "/" + name
+	objectUrl.Path = path
+	objectUrl.RawPath = s3EscapePath(path)
+
+	return objectUrl
+}
+
+func (s *S3Storage) do(
+	ctx context.Context,
+	method,
+	bucket,
+	name string,
+	query url.Values,
+	headers map[string]string,
+	body []byte,
+) (*http.Response, error) {
+	requestUrl := s.objectUrl(bucket, name)
+	requestUrl.RawQuery = s3CanonicalQuery(query)
+
+	request, e := http.NewRequestWithContext(ctx, method, requestUrl.String(), bytes.NewReader(body))
+	if e != nil {
+		return nil, e
+	}
+	request.ContentLength = int64(len(body))
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+
+	s.sign(request, requestUrl, body, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, e := client.Do(request)
+	if e != nil {
+		return nil, e
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusNotFound && name != "" {
+			return nil, ErrObjectNotExist
+		}
+		// a conflicting concurrent conditional write is reported as 409 rather than 412
+		conditional := request.Header.Get("If-Match") != "" || request.Header.Get("If-None-Match") != ""
+		if response.StatusCode == http.StatusPreconditionFailed ||
+			(conditional && response.StatusCode == http.StatusConflict) {
+			return nil, ErrConflict
+		}
+
+		var s3Error s3ErrorResponse
+		responseBody, _ := ioutil.ReadAll(response.Body)
+		if xml.Unmarshal(responseBody, &s3Error) != nil || s3Error.Code == "" {
+			s3Error.Code = response.Status
+		}
+
+		return nil, fmt.Errorf("s3 %s %s/%s failed: %s %s", method, bucket, name, s3Error.Code, s3Error.Message)
+	}
+
+	return response, nil
+}
+
+// sign adds an AWS signature version 4 Authorization header to the request
+func (s *S3Storage) sign(request *http.Request, requestUrl *url.URL, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	request.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+	request.Header.Set("x-amz-date", now.Format(s3DateTimeFormat))
+	if s.SessionToken != "" {
+		request.Header.Set("x-amz-security-token", s.SessionToken)
+	}
+
+	if s.AccessKeyId == "" {
+		return
+	}
+
+	canonicalHeaders := map[string]string{
+		"host": request.URL.Host,
+	}
+	for key := range request.Header {
+		lower := strings.ToLower(key)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			canonicalHeaders[lower] = strings.TrimSpace(request.Header.Get(key))
+		}
+	}
+	var headerNames []string
+	for key := range canonicalHeaders {
+		headerNames = append(headerNames, key)
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaderLines []string
+	for _, key := range headerNames {
+		canonicalHeaderLines = append(canonicalHeaderLines, key+":"+canonicalHeaders[key]+"\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		requestUrl.EscapedPath(),
+		requestUrl.RawQuery,
+		strings.Join(canonicalHeaderLines, ""),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := strings.Join([]string{now.Format(s3DateFormat), s.Region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format(s3DateTimeFormat),
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	signingKey := s3Hmac([]byte("AWS4"+s.SecretAccessKey), now.Format(s3DateFormat))
+	signingKey = s3Hmac(signingKey, s.Region)
+	signingKey = s3Hmac(signingKey, "s3")
+	signingKey = s3Hmac(signingKey, "aws4_request")
+
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm,
+		s.AccessKeyId,
+		scope,
+		signedHeaders,
+		hex.EncodeToString(s3Hmac(signingKey, stringToSign)),
+	))
+}
+
+func s3Hmac(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent encodes everything except the unreserved characters, as required by signature version 4
+func s3Escape(value string, keepSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (keepSlash && b == '/') {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func s3EscapePath(path string) string {
+	return s3Escape(path, true)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var keys []string
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+type s3Writer struct {
+	Ctx     context.Context
+	Storage *S3Storage
+	Bucket  string
+	Name    string
+	Headers map[string]string
+	buffer  bytes.Buffer
+	closed  bool
+	object  *ObjectInfo
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	e := w.Ctx.Err()
+	if e != nil {
+		return 0, e
+	}
+
+	return w.buffer.Write(p)
+}
+
+// Close uploads the buffered object, S3 requires the content length of a PUT up front
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	response, e := w.Storage.do(w.Ctx, http.MethodPut, w.Bucket, w.Name, nil, w.Headers, w.buffer.Bytes())
+	if e != nil {
+		return e
+	}
+	w.object = &ObjectInfo{
+		Name: w.Name,
+		Size: int64(w.buffer.Len()),
+		Etag: response.Header.Get("ETag"),
+	}
+
+	return response.Body.Close()
+}
+
+func (w *s3Writer) Object() *ObjectInfo {
+	return w.object
+}
+
+type s3ListBucketResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+		ETag         string
+	}
+}
+
+type s3ErrorResponse struct {
+	Code    string
+	Message string
+}
@@ -0,0 +1,42 @@
+package cbpatch
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PublicUrlResolver returns the URL a public object within a storage bucket can be fetched from over HTTP(S)
+type PublicUrlResolver func(storageBucketName string, name string) string
+
+// NewPublicUrlTemplate creates a PublicUrlResolver from a template containing {bucket} and {name} placeholders,
+// e.g. https://cdn.example.com/{name}
+func NewPublicUrlTemplate(template string) PublicUrlResolver {
+	return func(storageBucketName string, name string) string {
+		return strings.NewReplacer(
+			"{bucket}", storageBucketName,
+			"{name}", name,
+		).Replace(template)
+	}
+}
+
+// NewStoragePublicUrlResolver creates a PublicUrlResolver which asks the Storage for its public URLs,
+// falling back to GCS when the Storage does not implement PublicUrlStorage
+func NewStoragePublicUrlResolver(storage Storage) PublicUrlResolver {
+	return func(storageBucketName string, name string) string {
+		if publicStorage, ok := storage.(PublicUrlStorage); ok {
+			return publicStorage.PublicUrl(storageBucketName, name)
+		}
+
+		return fmt.Sprintf("https://storage.googleapis.com/%s/%s", storageBucketName, name)
+	}
+}
+
+// withCacheBuster appends a query parameter to a URL so intermediate caches are bypassed
+func withCacheBuster(url string, value int64) string {
+	separator := "?"
+	if strings.Contains(url, "?") {
+		separator = "&"
+	}
+
+	return fmt.Sprintf("%s%s%d", url, separator, value)
+}
@@ -0,0 +1,280 @@
+package cbpatch
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/csv"
+	"fmt"
+	"github.com/codingbeard/cbutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versionPath returns the remote path of the immutable master written by the publish with the given version,
+// e.g. master-1600000000-0a1b2c3d.csv for a master named master.csv
+func (m *Master) versionPath(version string) string {
+	extension := path.Ext(m.FileName)
+
+	return joinPath(m.RemoteDir, strings.TrimSuffix(m.FileName, extension)+"-"+version+extension)
+}
+
+// parseVersionPath returns the version of a remote versioned master path, false for any other object
+func (m *Master) parseVersionPath(remotePath string) (string, bool) {
+	extension := path.Ext(m.FileName)
+	prefix := joinPath(m.RemoteDir, strings.TrimSuffix(m.FileName, extension)+"-")
+	if !strings.HasPrefix(remotePath, prefix) || !strings.HasSuffix(remotePath, extension) {
+		return "", false
+	}
+	version := strings.TrimSuffix(strings.TrimPrefix(remotePath, prefix), extension)
+	if _, ok := versionUnixTime(version); !ok {
+		return "", false
+	}
+
+	return version, true
+}
+
+// versionUnixTime returns the unix time a version was published at, which starts it
+func versionUnixTime(version string) (int64, bool) {
+	index := strings.Index(version, "-")
+	if index < 0 {
+		return 0, false
+	}
+	unixTime, e := strconv.ParseInt(version[:index], 10, 64)
+	if e != nil {
+		return 0, false
+	}
+
+	return unixTime, true
+}
+
+func (m *Master) Versions() ([]string, error) {
+	return m.VersionsContext(context.Background())
+}
+
+// VersionsContext returns the versions of the masters written by past publishes which are still stored, oldest
+// first. Publishes only write versions when RetainedVersions is set.
+func (m *Master) VersionsContext(ctx context.Context) ([]string, error) {
+	if m.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	files, e := m.Storage.Ls(ctx, m.StorageBucketName, m.RemoteDir)
+	if e != nil {
+		m.ErrorHandler.Error(e)
+		return nil, e
+	}
+
+	var versionFiles []*ObjectInfo
+	for _, file := range files {
+		_, ok := m.parseVersionPath(file.Name)
+		if ok {
+			versionFiles = append(versionFiles, file)
+		}
+	}
+	// versions published within the same second are ordered by when they were written
+	sort.Slice(versionFiles, func(i, j int) bool {
+		iVersion, _ := m.parseVersionPath(versionFiles[i].Name)
+		jVersion, _ := m.parseVersionPath(versionFiles[j].Name)
+		iTime, _ := versionUnixTime(iVersion)
+		jTime, _ := versionUnixTime(jVersion)
+		if iTime != jTime {
+			return iTime < jTime
+		}
+		return versionFiles[i].Created.Before(versionFiles[j].Created)
+	})
+
+	versions := make([]string, 0, len(versionFiles))
+	for _, file := range versionFiles {
+		version, _ := m.parseVersionPath(file.Name)
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
+
+// readVersion downloads the rows of a versioned master
+func (m *Master) readVersion(ctx context.Context, version string) ([][]string, error) {
+	remotePath := m.versionPath(version)
+	var buffer bytes.Buffer
+	e := m.Storage.DownloadWriter(ctx, m.StorageBucketName, remotePath, &buffer)
+	if e != nil {
+		return nil, e
+	}
+
+	reader := csv.NewReader(&buffer)
+	reader.FieldsPerRecord = -1
+	rows, e := reader.ReadAll()
+	if e != nil {
+		return nil, &MalformedRowError{Path: remotePath, Reason: "unreadable csv", Err: e}
+	}
+
+	return rows, nil
+}
+
+// uploadVersion writes the rows of a master as an immutable versioned master and returns their checksum
+func (m *Master) uploadVersion(ctx context.Context, remotePath string, rows [][]string) (string, error) {
+	var buffer bytes.Buffer
+	versionCsv := csv.NewWriter(&buffer)
+	e := versionCsv.WriteAll(rows)
+	if e != nil {
+		return "", e
+	}
+	checksum := fmt.Sprintf("%x", md5.Sum(buffer.Bytes()))
+
+	m.Logger.InfoF("debug", "uploading: %s", remotePath)
+	// the zero precondition refuses to replace an existing version
+	storageWriter, e := m.Storage.GetConditionalUploadWriter(ctx, m.StorageBucketName, remotePath, Precondition{})
+	if e != nil {
+		return "", e
+	}
+	_, e = copyContext(ctx, storageWriter, &buffer)
+	if e != nil {
+		storageWriter.Close()
+		return "", e
+	}
+	e = storageWriter.Close()
+	if e != nil {
+		return "", e
+	}
+
+	if m.Public {
+		e = m.Storage.MakePublic(ctx, m.StorageBucketName, remotePath)
+		if e != nil {
+			return "", e
+		}
+	}
+
+	return checksum, nil
+}
+
+// retainedFiles returns the remote paths of the RetainedVersions most recent versioned masters, along with the
+// buckets and categories they reference
+func (m *Master) retainedFiles(ctx context.Context) (map[string]bool, error) {
+	retained := make(map[string]bool)
+	if m.RetainedVersions <= 0 {
+		return retained, nil
+	}
+
+	versions, e := m.VersionsContext(ctx)
+	if e != nil {
+		return nil, e
+	}
+	if len(versions) > m.RetainedVersions {
+		versions = versions[len(versions)-m.RetainedVersions:]
+	}
+	for _, version := range versions {
+		rows, e := m.readVersion(ctx, version)
+		if e != nil {
+			m.ErrorHandler.Error(e)
+			return nil, e
+		}
+		retained[m.versionPath(version)] = true
+		for _, row := range rows {
+			if len(row) == 6 {
+				retained[joinPath(m.RemoteDir, row[1])] = true
+			}
+		}
+	}
+
+	return retained, nil
+}
+
+func (m *Master) Rollback(version string) error {
+	return m.RollbackContext(context.Background(), version)
+}
+
+// RollbackContext publishes the buckets and categories of the master written by an earlier publish again, see
+// VersionsContext. They must not have been deleted by CleanupOldFiles, which keeps those referenced by the
+// RetainedVersions most recent versions. Like a publish a ConflictError is returned when the remote master changed
+// since it was downloaded. Pending patches are discarded and the master is refreshed afterwards.
+func (m *Master) RollbackContext(ctx context.Context, version string) error {
+	if m.ReadOnly {
+		return ErrReadOnly
+	}
+	e := m.checkPublishLock()
+	if e != nil {
+		return e
+	}
+
+	journal, e := m.readJournal()
+	if e != nil {
+		m.ErrorHandler.Error(e)
+		return e
+	}
+	if journal != nil {
+		return ErrInterruptedPublish
+	}
+
+	m.Precondition, e = m.publishPrecondition(ctx)
+	if e != nil {
+		return e
+	}
+
+	versionRows, e := m.readVersion(ctx, version)
+	if e != nil {
+		m.ErrorHandler.Error(e)
+		return e
+	}
+
+	files, e := m.Storage.Ls(ctx, m.StorageBucketName, m.RemoteDir)
+	if e != nil {
+		m.ErrorHandler.Error(e)
+		return e
+	}
+	existing := make(map[string]bool)
+	for _, file := range files {
+		existing[file.Name] = true
+	}
+
+	m.Logger.InfoF("debug", "rolling back to version %s", version)
+	now := time.Now()
+	unixTime := now.Unix()
+	publishId, e := newPublishId(unixTime)
+	if e != nil {
+		m.ErrorHandler.Error(e)
+		return e
+	}
+
+	rows := [][]string{{
+		"V1",
+		strconv.FormatInt(unixTime, 10),
+		now.Format(cbutil.DateTimeFormat),
+	}}
+	for _, row := range versionRows {
+		if len(row) != 6 {
+			continue
+		}
+		remotePath := joinPath(m.RemoteDir, row[1])
+		if !existing[remotePath] {
+			e = fmt.Errorf("%w: %s referenced by version %s", ErrNotFound, remotePath, version)
+			m.ErrorHandler.Error(e)
+			return e
+		}
+		rows = append(rows, row)
+	}
+
+	journal = &publishJournal{
+		Phase:        journalPhaseStaging,
+		Precondition: m.Precondition,
+		Staged:       make(map[string]string),
+	}
+	if m.RetainedVersions > 0 {
+		journal.Staged[m.versionPath(publishId)] = ""
+	}
+	e = m.writeJournal(journal)
+	if e != nil {
+		m.ErrorHandler.Error(e)
+		return e
+	}
+
+	e = m.finishPublish(ctx, journal, publishId, rows)
+	if e != nil {
+		return e
+	}
+
+	return m.RefreshContext(ctx)
+}
@@ -0,0 +1,157 @@
+package cbpatch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMaster_Versions(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+
+	unversioned := downloadTestMaster(t, storage, filepath.Join(dir, "unversioned"), nil)
+	addTestPatch(t, unversioned, ActionAdd, "key", "0")
+	publishTestMaster(t, unversioned)
+	versions, e := unversioned.Versions()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(versions) != 0 {
+		t.Errorf("expected no versions without RetainedVersions, got %v", versions)
+	}
+
+	m := downloadTestMaster(t, storage, filepath.Join(dir, "versioned"), func(config *Config) {
+		config.RetainedVersions = 2
+	})
+	var published []string
+	for _, value := range []string{"1", "2", "3"} {
+		addTestPatch(t, m, ActionAdd, "key", value)
+		publishTestMaster(t, m)
+		versions, e = m.Versions()
+		if e != nil {
+			t.Fatal(e)
+		}
+		published = append(published, versions[len(versions)-1])
+	}
+	if !reflect.DeepEqual(versions, published) {
+		t.Errorf("expected every version oldest first, got %v", versions)
+	}
+	for _, version := range versions {
+		if _, ok := storage.Get("bucket", m.versionPath(version)); !ok {
+			t.Errorf("expected version %s to be stored", version)
+		}
+		if parsed, ok := m.parseVersionPath(m.versionPath(version)); !ok || parsed != version {
+			t.Errorf("expected %s to be parsed as %s, got %s", m.versionPath(version), version, parsed)
+		}
+	}
+	if _, ok := m.parseVersionPath("lists/master.csv"); ok {
+		t.Error("expected the master not to be a version")
+	}
+
+	readOnly := downloadTestMaster(t, storage, filepath.Join(dir, "readOnly"), func(config *Config) {
+		config.ReadOnly = true
+	})
+	_, e = readOnly.Versions()
+	if e != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", e)
+	}
+}
+
+func TestMaster_CleanupOldFiles_RetainedVersions(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+	storage.Now = func() time.Time {
+		return time.Now().Add(-25 * time.Hour)
+	}
+
+	m := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), func(config *Config) {
+		config.RetainedVersions = 2
+	})
+	var buckets []string
+	for _, value := range []string{"1", "2", "3"} {
+		// every publish uploads the bucket again under a new name
+		addTestPatch(t, m, ActionAdd, "key", value)
+		publishTestMaster(t, m)
+		buckets = append(buckets, m.Buckets[0].RemoteFilePath)
+	}
+	versions, e := m.Versions()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	e = m.CleanupOldFiles()
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i, version := range versions {
+		kept := i > 0
+		if _, ok := storage.Get("bucket", m.versionPath(version)); ok != kept {
+			t.Errorf("expected version %d kept to be %t", i+1, kept)
+		}
+		if _, ok := storage.Get("bucket", buckets[i]); ok != kept {
+			t.Errorf("expected the bucket of version %d kept to be %t", i+1, kept)
+		}
+	}
+}
+
+func TestMaster_Rollback(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+	versioned := func(config *Config) {
+		config.RetainedVersions = 5
+	}
+
+	m := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), versioned)
+	addTestPatch(t, m, ActionAdd, "a", "1")
+	publishTestMaster(t, m)
+	_, e := m.newBucket(2)
+	if e != nil {
+		t.Fatal(e)
+	}
+	addTestPatch(t, m, ActionAdd, "b", "1")
+	publishTestMaster(t, m)
+	versions, e := m.Versions()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	stale := downloadTestMaster(t, storage, filepath.Join(dir, "stale"), versioned)
+	// pending patches are discarded by the rollback
+	addTestPatch(t, m, ActionAdd, "pending", "1")
+	e = m.Rollback(versions[0])
+	if e != nil {
+		t.Fatal(e)
+	}
+	expected := map[string][]string{"a": {"1"}}
+	if list := compileTestList(t, m); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected the master to be refreshed with %v, got %v", expected, list)
+	}
+	consumer := downloadTestMaster(t, storage, filepath.Join(dir, "consumer"), nil)
+	if list := compileTestList(t, consumer); !reflect.DeepEqual(list, expected) {
+		t.Errorf("expected %v, got %v", expected, list)
+	}
+	afterRollback, e := m.Versions()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(afterRollback) != 3 {
+		t.Errorf("expected the rollback to write a version, got %v", afterRollback)
+	}
+
+	e = stale.Rollback(versions[1])
+	var conflict *ConflictError
+	if !errors.As(e, &conflict) {
+		t.Errorf("expected a ConflictError rolling back a stale master, got %v", e)
+	}
+	e = m.Rollback("1-missing")
+	if !errors.Is(e, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a missing version, got %v", e)
+	}
+}
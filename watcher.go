@@ -0,0 +1,190 @@
+package cbpatch
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+type WatchEventType string
+
+const (
+	WatchEventAdded   WatchEventType = "added"
+	WatchEventUpdated WatchEventType = "updated"
+	WatchEventRemoved WatchEventType = "removed"
+	WatchEventCleared WatchEventType = "cleared"
+)
+
+// WatchEvent is a change to the compiled list. OldValues is empty for added keys and NewValues for removed keys,
+// cleared events have neither and no Key.
+type WatchEvent struct {
+	Type      WatchEventType
+	Key       string
+	OldValues []string
+	NewValues []string
+}
+
+// Watcher polls a master and calls Handler with every change to its compiled list. Only new or changed buckets
+// are downloaded, the first poll reports every key as added and expired keys are reported as removed. When a clear
+// patch was applied since the last poll a single cleared event is sent instead of a removal per key, followed by
+// every key as added. Events are sent again by the next poll if Handler fails.
+type Watcher struct {
+	Master   *Master
+	Interval time.Duration
+	Handler  func(event WatchEvent) error
+	last     watchSnapshot
+}
+
+// watchSnapshot is the list emitted by a poll, with the checksum of the master and the compiled state it came from
+type watchSnapshot struct {
+	list     map[string][]string
+	checksum string
+	state    *listState
+	clears   int
+}
+
+// NewWatcher creates a Watcher for a master which has not been initialised, usually a ReadOnly one
+func NewWatcher(master *Master, interval time.Duration, handler func(event WatchEvent) error) *Watcher {
+	return &Watcher{
+		Master:   master,
+		Interval: interval,
+		Handler:  handler,
+	}
+}
+
+// Run polls every Interval until the context is done or Handler returns an error. Failed downloads are retried
+// on the next poll.
+func (w *Watcher) Run(ctx context.Context) error {
+	for true {
+		events, snapshot, e := w.changes(ctx)
+		if e != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			w.Master.Logger.InfoF("debug", "watcher poll failed, retrying in %s: %s", w.Interval, e.Error())
+		} else {
+			e = w.emit(events, snapshot)
+			if e != nil {
+				return e
+			}
+		}
+
+		e = sleepContext(ctx, w.Interval)
+		if e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// Poll downloads the master once and calls Handler with the changes since the previous poll
+func (w *Watcher) Poll(ctx context.Context) error {
+	events, snapshot, e := w.changes(ctx)
+	if e != nil {
+		return e
+	}
+
+	return w.emit(events, snapshot)
+}
+
+// changes refreshes the master and returns the events leading from the last emitted list to the new one, along
+// with a snapshot of the new list
+func (w *Watcher) changes(ctx context.Context) ([]WatchEvent, watchSnapshot, error) {
+	if w.Master.File == nil {
+		e := w.Master.Init()
+		if e != nil {
+			return nil, watchSnapshot{}, e
+		}
+	}
+	e := w.Master.RefreshContext(ctx)
+	if e != nil {
+		return nil, watchSnapshot{}, e
+	}
+	checksum, e := checksumReadSeeker(w.Master.File)
+	if e != nil {
+		return nil, watchSnapshot{}, e
+	}
+	// keys may have expired since the last poll even though the master has not changed
+	if checksum == w.last.checksum && (w.last.state == nil || len(w.last.state.Expires) == 0) {
+		w.Master.Logger.DebugF("debug", "watched master unchanged since %s", w.Master.DateTime)
+		return nil, w.last, nil
+	}
+
+	list, e := w.Master.CompileList()
+	if e != nil {
+		return nil, watchSnapshot{}, e
+	}
+	snapshot := watchSnapshot{
+		list:     list,
+		checksum: checksum,
+		state:    w.Master.compiled.State,
+		clears:   w.Master.compiled.State.Clears,
+	}
+
+	// a clear is only known to have been applied when the state was resumed rather than replayed from scratch
+	cleared := len(w.last.list) > 0 && snapshot.state == w.last.state && snapshot.clears > w.last.clears
+
+	var events []WatchEvent
+	if cleared {
+		events = append(events, WatchEvent{Type: WatchEventCleared})
+	} else {
+		for key, values := range w.last.list {
+			if _, ok := list[key]; !ok {
+				events = append(events, WatchEvent{Type: WatchEventRemoved, Key: key, OldValues: values})
+			}
+		}
+	}
+	for key, values := range list {
+		oldValues, ok := w.last.list[key]
+		if !ok || cleared {
+			events = append(events, WatchEvent{Type: WatchEventAdded, Key: key, NewValues: values})
+		} else if !equalValues(oldValues, values) {
+			events = append(events, WatchEvent{
+				Type:      WatchEventUpdated,
+				Key:       key,
+				OldValues: oldValues,
+				NewValues: values,
+			})
+		}
+	}
+	// removals and the clear come first, then keys in order, so handlers see a repeatable sequence
+	sort.SliceStable(events, func(i, j int) bool {
+		if isRemoval(events[i]) != isRemoval(events[j]) {
+			return isRemoval(events[i])
+		}
+		return events[i].Key < events[j].Key
+	})
+
+	return events, snapshot, nil
+}
+
+// emit calls Handler with each event, keeping the new snapshot only once every event has been handled
+func (w *Watcher) emit(events []WatchEvent, snapshot watchSnapshot) error {
+	for _, event := range events {
+		e := w.Handler(event)
+		if e != nil {
+			return e
+		}
+	}
+	w.last = snapshot
+
+	return nil
+}
+
+func isRemoval(event WatchEvent) bool {
+	return event.Type == WatchEventRemoved || event.Type == WatchEventCleared
+}
+
+func equalValues(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,77 @@
+package cbpatch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWatcher_Poll(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewMemoryStorage()
+
+	publisher := downloadTestMaster(t, storage, filepath.Join(dir, "publisher"), nil)
+	var events []WatchEvent
+	watcher := NewWatcher(
+		NewMaster(Config{
+			StorageBucketName: "bucket",
+			RemoteDir:         "lists",
+			Dir:               filepath.Join(dir, "watcher"),
+			FileName:          "master.csv",
+			ReadOnly:          true,
+			Validation: func(line []string, bucket *Bucket) error {
+				return nil
+			},
+			ErrorHandler: testErrorHandler{},
+			Logger:       testLogger{},
+			Storage:      storage,
+		}),
+		0,
+		func(event WatchEvent) error {
+			events = append(events, event)
+			return nil
+		},
+	)
+	e := os.MkdirAll(filepath.Join(dir, "watcher"), os.ModePerm)
+	if e != nil {
+		t.Fatal(e)
+	}
+	poll := func(expected ...WatchEvent) {
+		t.Helper()
+		events = nil
+		e := watcher.Poll(context.Background())
+		if e != nil {
+			t.Fatal(e)
+		}
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("expected %v, got %v", expected, events)
+		}
+	}
+
+	addTestPatch(t, publisher, ActionAdd, "a", "1")
+	publishTestMaster(t, publisher)
+	poll(WatchEvent{Type: WatchEventAdded, Key: "a", NewValues: []string{"1"}})
+
+	// removing the only key is a removal, not a clear
+	addTestPatch(t, publisher, ActionRemove, "a")
+	addTestPatch(t, publisher, ActionAdd, "b", "1")
+	addTestPatch(t, publisher, ActionAdd, "c", "1")
+	publishTestMaster(t, publisher)
+	poll(
+		WatchEvent{Type: WatchEventRemoved, Key: "a", OldValues: []string{"1"}},
+		WatchEvent{Type: WatchEventAdded, Key: "b", NewValues: []string{"1"}},
+		WatchEvent{Type: WatchEventAdded, Key: "c", NewValues: []string{"1"}},
+	)
+	poll()
+
+	addTestPatch(t, publisher, ActionClear, "")
+	addTestPatch(t, publisher, ActionAdd, "b", "1")
+	publishTestMaster(t, publisher)
+	poll(
+		WatchEvent{Type: WatchEventCleared},
+		WatchEvent{Type: WatchEventAdded, Key: "b", NewValues: []string{"1"}},
+	)
+}